@@ -1,12 +1,15 @@
 package subsystems
 
-// ResourceConfig 用于传递资源限制配置的结构体，包含内存限制，CPU 时间片权重，CPU核心数
+// ResourceConfig 用于传递资源限制配置的结构体，包含内存限制，CPU 时间片权重，CPU核心数，网络带宽
+// 网络带宽不通过 cgroup 限制，而是由 network 包在容器的 Net Namespace 中配置 tc 实现
 type ResourceConfig struct {
 	MemoryLimit     string
 	CpuShare        string
 	CpuSet          string
 	MemorySwapLimit int
 	CpuCfsQuota     int
+	NetRate         string // 容器发出流量的速率限制，tc 格式，例如 10mbit
+	NetIngressRate  string // 容器收到流量的速率限制，tc 格式
 }
 
 // Subsystem 接口，每个Subsystem可以实现下面的4个接口，
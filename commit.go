@@ -1,27 +1,103 @@
 package main
 
 import (
+	"compress/gzip"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"mydocker/container"
+	"mydocker/image"
 	"mydocker/utils"
-	"os/exec"
+	"os"
 )
 
 var ErrImageAlreadyExists = errors.New("Image Already Exists")
 
-func commitContainer(containerID, imageName string) error {
-	mntPath := utils.GetMerged(containerID)
-	imageTar := utils.GetImage(imageName)
-	exists, err := utils.PathExists(imageTar)
+// commitContainer 将容器提交为新镜像
+/*
+新镜像引用容器所用镜像(父镜像)的所有层，再加上只包含容器修改的一层，即容器的 upper 目录，
+upper 目录中 overlayfs 的 whiteout 会被转换为 OCI 格式的 .wh. 文件。
+容器没有记录镜像 Id 或者镜像已经不存在时，打包整个 merged 目录作为单层镜像。
+新镜像的配置来自容器的配置，再依次应用 changes 中的指令，例如 CMD、ENV。
+*/
+func commitContainer(containerID, imageName string, changes []string) error {
+	if _, err := image.DefaultStore.Get(imageName); err == nil {
+		return ErrImageAlreadyExists
+	} else if !errors.Is(err, image.ErrImageNotFound) {
+		return errors.WithMessagef(err, "check is image [%s] exist failed", imageName)
+	}
+	parent, layerPath := getCommitParent(containerID)
+	config, err := getCommitConfig(containerID, parent, changes)
 	if err != nil {
-		return errors.WithMessagef(err, "check is image [%s/%s] exist failed", imageName, imageTar)
+		return err
 	}
-	if exists {
-		return ErrImageAlreadyExists
+	// upper 目录中 init 进程创建的 /etc 文件挂载点不属于容器的修改
+	var excludes []string
+	if parent != nil {
+		excludes = container.EtcMountPoints()
 	}
-	log.Infof("commitContainer imageTar:%s", imageTar)
-	if _, err = exec.Command("tar", "-czf", imageTar, "-C", mntPath, ".").CombinedOutput(); err != nil {
-		return errors.WithMessagef(err, "tar folder %s failed", mntPath)
+	imageTar, err := writeCommitLayer(layerPath, excludes)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(imageTar)
+	img, err := image.DefaultStore.Create(imageName, parent, imageTar, config)
+	if err != nil {
+		return errors.WithMessagef(err, "create image %s", imageName)
 	}
+	log.Infof("commit container %s as image %s(%s)", containerID, imageName, image.ShortID(img.ID))
 	return nil
 }
+
+// getCommitParent 返回新镜像的父镜像以及需要打包的目录
+func getCommitParent(containerID string) (*image.Image, string) {
+	info, err := getInfoByContainerId(containerID)
+	if err != nil || info.ImageID == "" {
+		return nil, utils.GetMerged(containerID)
+	}
+	parent, err := image.DefaultStore.Get(info.ImageID)
+	if err != nil {
+		log.Warnf("get image %s of container %s error %v, commit whole rootfs", info.ImageID, containerID, err)
+		return nil, utils.GetMerged(containerID)
+	}
+	return parent, utils.GetUpper(containerID)
+}
+
+// getCommitConfig 返回新镜像的配置，容器没有记录配置时使用父镜像的配置
+func getCommitConfig(containerID string, parent *image.Image, changes []string) (*image.ContainerConfig, error) {
+	config := &image.ContainerConfig{}
+	if info, err := getInfoByContainerId(containerID); err == nil && info.Config != nil {
+		config = info.Config
+	} else if parent != nil {
+		imgConfig, err := image.DefaultStore.Config(parent)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "get config of image %s", parent.ID)
+		}
+		config = &imgConfig.Config
+	}
+	for _, change := range changes {
+		if err := config.ApplyChange(change); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// writeCommitLayer 先打包到镜像目录下的临时文件，再导入镜像存储，excludes 中的路径不会被打包
+func writeCommitLayer(layerPath string, excludes []string) (string, error) {
+	tmpFile, err := os.CreateTemp(utils.ImagePath, "commit-*.tmp")
+	if err != nil {
+		return "", errors.Wrap(err, "create temp image file")
+	}
+	defer tmpFile.Close()
+	log.Infof("commitContainer imageTar:%s", tmpFile.Name())
+	gw := gzip.NewWriter(tmpFile)
+	if err = image.WriteLayer(gw, layerPath, excludes...); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return "", errors.WithMessagef(err, "tar folder %s failed", layerPath)
+	}
+	if err = gw.Close(); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return "", errors.Wrap(err, "compress layer")
+	}
+	return tmpFile.Name(), nil
+}
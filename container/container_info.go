@@ -8,26 +8,16 @@ import (
 	"mydocker/constant"
 	"os"
 	"path"
-	"strconv"
-	"strings"
 	"time"
 )
 
-func RecordContainerInfo(containerPID int, commandArray []string, containerName, containerId, volume string) error {
-	// 如果未指定容器名，则使用随机生成的containerID
-	if containerName == "" {
-		containerName = containerId
-	}
-	command := strings.Join(commandArray, "")
-	containerInfo := &Info{
-		Id:          containerId,
-		Pid:         strconv.Itoa(containerPID),
-		Command:     command,
-		CreatedTime: time.Now().Format("2006-01-02 15:04:05"),
-		Status:      RUNNING,
-		Name:        containerName,
-		Volume:      volume,
+// RecordContainerInfo 将容器信息写入容器信息目录下的 config.json，未指定容器名时使用容器 Id
+func RecordContainerInfo(containerInfo *Info) error {
+	if containerInfo.Name == "" {
+		containerInfo.Name = containerInfo.Id
 	}
+	containerInfo.CreatedTime = time.Now().Format("2006-01-02 15:04:05")
+	containerInfo.Status = RUNNING
 
 	jsonBytes, err := json.Marshal(containerInfo)
 	if err != nil {
@@ -36,7 +26,7 @@ func RecordContainerInfo(containerPID int, commandArray []string, containerName,
 
 	jsonStr := string(jsonBytes)
 	// 拼接出存储容器信息文件的路径，如果目录不存在则级联创建
-	dirPath := fmt.Sprintf(InfoLocFormat, containerId)
+	dirPath := fmt.Sprintf(InfoLocFormat, containerInfo.Id)
 	if err := os.MkdirAll(dirPath, constant.Perm0622); err != nil {
 		return errors.WithMessagef(err, "mkdir %s failed", dirPath)
 	}
@@ -1,12 +1,17 @@
 package container
 
 import (
+	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"mydocker/cgroups/subsystems"
 	"mydocker/constant"
+	"mydocker/image"
+	"mydocker/network"
 	"mydocker/utils"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 )
 
@@ -19,19 +24,83 @@ const (
 	ConfigName    = "config.json"
 	IDLength      = 10
 	LogFile       = "%s-json.log"
+	// EnvContainerId 通过环境变量把容器 Id 传给 init 进程，init 进程读取后会将其删除，不会传递给用户进程
+	EnvContainerId = "mydocker_container_id"
+	// EnvHostname 通过环境变量把容器主机名传给 init 进程，用法同 EnvContainerId
+	EnvHostname = "mydocker_hostname"
+	// EnvNetNs container 网络模式下 init 进程需要加入的 Net Namespace 路径，用法同 EnvContainerId
+	EnvNetNs = "mydocker_netns"
+	// EnvNetMode 通过环境变量把网络模式传给 init 进程，用法同 EnvContainerId
+	EnvNetMode = "mydocker_netmode"
+	// EnvWorkingDir 通过环境变量把镜像配置的工作目录传给 init 进程，用法同 EnvContainerId
+	EnvWorkingDir = "mydocker_workdir"
+)
+
+// 容器网络模式
+const (
+	NetModeBridge    = "bridge"        // 连接到 bridge 网络，默认网络或者 network create 创建的网络
+	NetModeNone      = "none"          // 独立的 Net Namespace，只有 lo 网卡
+	NetModeHost      = "host"          // 和宿主机共享 Net Namespace
+	NetModeContainer = "container"     // 和另一个容器共享 Net Namespace，格式为 container:<id>
+	NetModeMacvlan   = network.Macvlan // macvlan 子接口，格式为 macvlan:<parent>,<cidr>[,<gateway>]
+	NetModeIpvlan    = network.Ipvlan  // ipvlan 子接口，格式同 macvlan
+	NetModeCNI       = network.CNI     // 调用 CNI 插件配置网络，格式为 cni:<network name>
 )
 
 type Info struct {
-	Pid         string `json:"pid"`        // 容器的init进程在宿主机上的 PID
-	Id          string `json:"id"`         // 容器Id
-	Name        string `json:"name"`       // 容器名
-	Command     string `json:"command"`    // 容器内init运行命令
-	CreatedTime string `json:"createTime"` // 创建时间
-	Status      string `json:"status"`     // 容器的状态
-	Volume      string `json:"volume"`     // 容器挂载的 volume
+	Pid           string                       `json:"pid"`                 // 容器的init进程在宿主机上的 PID
+	Id            string                       `json:"id"`                  // 容器Id
+	Name          string                       `json:"name"`                // 容器名
+	Command       string                       `json:"command"`             // 容器内init运行命令
+	Image         string                       `json:"image"`               // 创建容器时指定的镜像
+	ImageID       string                       `json:"imageId"`             // 镜像 Id，删除镜像时用于判断镜像是否被容器使用
+	CreatedTime   string                       `json:"createTime"`          // 创建时间
+	Status        string                       `json:"status"`              // 容器的状态
+	Volume        string                       `json:"volume"`              // 容器挂载的 volume
+	NetworkName   string                       `json:"networkName"`         // 容器所在的网络
+	IP            string                       `json:"ip"`                  // 容器 IP
+	IPv6          string                       `json:"ipv6"`                // 容器 IPv6 地址，cidr 格式，未开启 IPv6 时为空
+	PortMapping   []string                     `json:"portmapping"`         // 端口映射，格式为 hostPort:containerPort/proto
+	UserlandProxy bool                         `json:"userlandProxy"`       // 端口映射是否使用 userland proxy 而不是 iptables
+	Hostname      string                       `json:"hostname"`            // 容器主机名
+	NetMode       string                       `json:"netMode"`             // 网络模式，bridge、none、host、container:<id>、macvlan:...、ipvlan:... 或者 cni:<name>
+	Aliases       []string                     `json:"aliases"`             // 容器在网络中的别名，网络内置 DNS 会解析这些名字
+	Interfaces    []*network.AttachedInterface `json:"interfaces"`          // 通过 netattach 热插拔的网卡
+	Resource      *subsystems.ResourceConfig   `json:"resource"`            // 资源限制，网络带宽可以通过 update 命令修改
+	CNIResult     json.RawMessage              `json:"cniResult,omitempty"` // cni 模式下插件 ADD 返回的结果
+	Config        *image.ContainerConfig       `json:"config,omitempty"`    // 容器的命令、环境变量等配置，commit 时作为新镜像的配置
 }
 
-func NewParentProcess(tty bool, volume, containerId, imageName string, envSlice []string) (*exec.Cmd, *os.File) {
+// ParseNetMode 解析 --net 参数，返回网络模式以及对应的参数
+/*
+- 空或者 none: none 模式
+- host: host 模式
+- container:<id>: container 模式，参数为目标容器 Id
+- macvlan:<parent>,<cidr>[,<gateway>]、ipvlan:...: 子接口模式，参数为子接口配置
+- cni:<name>: cni 模式，参数为 CNI 网络名
+- 其他: bridge 模式，参数为网络名，bridge 表示默认网络
+*/
+func ParseNetMode(net string) (mode, arg string) {
+	switch {
+	case net == "" || net == NetModeNone:
+		return NetModeNone, ""
+	case net == NetModeHost:
+		return NetModeHost, ""
+	case strings.HasPrefix(net, NetModeContainer+":"):
+		return NetModeContainer, strings.TrimPrefix(net, NetModeContainer+":")
+	case strings.HasPrefix(net, NetModeMacvlan+":"):
+		return NetModeMacvlan, strings.TrimPrefix(net, NetModeMacvlan+":")
+	case strings.HasPrefix(net, NetModeIpvlan+":"):
+		return NetModeIpvlan, strings.TrimPrefix(net, NetModeIpvlan+":")
+	case strings.HasPrefix(net, NetModeCNI+":"):
+		return NetModeCNI, strings.TrimPrefix(net, NetModeCNI+":")
+	default:
+		return NetModeBridge, net
+	}
+}
+
+func NewParentProcess(tty bool, volume, containerId, imageName, hostname, netMode, netNsPath string,
+	envSlice []string, workingDir string) (*exec.Cmd, *os.File) {
 	readPipe, writePipe, err := os.Pipe() // cmd在readPipe读取数据
 	if err != nil {
 		log.Errorf("New pipe error %v", err)
@@ -45,6 +114,10 @@ func NewParentProcess(tty bool, volume, containerId, imageName string, envSlice
 		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
 			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
 	}
+	// host 模式直接使用宿主机的 Net Namespace，container 模式由 init 进程加入目标容器的 Net Namespace，都不需要新建
+	if netMode == NetModeHost || netMode == NetModeContainer {
+		cmd.SysProcAttr.Cloneflags &^= syscall.CLONE_NEWNET
+	}
 	if tty {
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
@@ -69,5 +142,13 @@ func NewParentProcess(tty bool, volume, containerId, imageName string, envSlice
 	NewWorkSpace(containerId, imageName, volume)
 	cmd.Dir = utils.GetMerged(containerId)
 	cmd.Env = append(os.Environ(), envSlice...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvContainerId, containerId), fmt.Sprintf("%s=%s", EnvHostname, hostname))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvNetMode, netMode))
+	if netNsPath != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvNetNs, netNsPath))
+	}
+	if workingDir != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvWorkingDir, workingDir))
+	}
 	return cmd, writePipe
 }
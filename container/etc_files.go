@@ -0,0 +1,168 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"mydocker/constant"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	HostsFile      = "hosts"
+	HostnameFile   = "hostname"
+	ResolvConfFile = "resolv.conf"
+	hostResolvConf = "/etc/resolv.conf"
+	hostHosts      = "/etc/hosts"
+)
+
+// etcFiles init 进程挂载到容器 /etc 下的文件
+var etcFiles = []string{HostsFile, HostnameFile, ResolvConfFile}
+
+// 宿主机 resolv.conf 中没有可用的 nameserver 时使用的默认 DNS
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// DNSConfig 容器的域名解析配置，对应 run 命令的 --dns、--dns-search、--add-host 参数
+type DNSConfig struct {
+	Nameservers []string // 指定的 DNS 服务器，为空时使用宿主机的配置
+	Search      []string // 指定的搜索域，为空时使用宿主机的配置
+	ExtraHosts  []string // 额外的 hosts 记录，格式为 host:ip
+}
+
+// EtcMountPoints 返回 init 进程挂载 /etc 文件的位置，路径相对于容器的 rootfs
+// 挂载点是 init 进程在 upper 目录中创建的空文件，commit 时需要排除
+func EtcMountPoints() []string {
+	mountPoints := make([]string, 0, len(etcFiles))
+	for _, name := range etcFiles {
+		mountPoints = append(mountPoints, path.Join("etc", name))
+	}
+	return mountPoints
+}
+
+// BuildEtcFiles 在容器信息目录下生成 hosts、hostname、resolv.conf 文件，init 进程会将它们 bind mount 到容器的 /etc 下
+// host 网络模式下容器和宿主机共享网络，因此 hosts 基于宿主机的 hosts 生成，resolv.conf 中的本地 DNS 也不需要过滤
+func BuildEtcFiles(containerId, hostname, containerIP string, hostNetwork bool, dnsConfig *DNSConfig) error {
+	dirPath := fmt.Sprintf(InfoLocFormat, containerId)
+	if err := os.MkdirAll(dirPath, constant.Perm0622); err != nil {
+		return errors.Wrapf(err, "mkdir %s", dirPath)
+	}
+	var baseHosts []byte
+	if hostNetwork {
+		content, err := os.ReadFile(hostHosts)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "read %s", hostHosts)
+		}
+		baseHosts = content
+	}
+	hosts, err := buildHosts(baseHosts, hostname, containerIP, dnsConfig.ExtraHosts)
+	if err != nil {
+		return err
+	}
+	hostResolv, err := os.ReadFile(hostResolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "read %s", hostResolvConf)
+	}
+	files := map[string][]byte{
+		HostsFile:      hosts,
+		HostnameFile:   []byte(hostname + "\n"),
+		ResolvConfFile: buildResolvConf(hostResolv, !hostNetwork, dnsConfig),
+	}
+	for name, content := range files {
+		filePath := path.Join(dirPath, name)
+		if err = os.WriteFile(filePath, content, constant.Perm0644); err != nil {
+			return errors.Wrapf(err, "write %s", filePath)
+		}
+	}
+	return nil
+}
+
+// buildHosts 生成 hosts 文件，包括 localhost、容器自身以及 --add-host 指定的记录，指定了 baseHosts 时用它代替默认的 localhost 记录
+func buildHosts(baseHosts []byte, hostname, containerIP string, extraHosts []string) ([]byte, error) {
+	var buf bytes.Buffer
+	if len(baseHosts) > 0 {
+		buf.Write(baseHosts)
+		if baseHosts[len(baseHosts)-1] != '\n' {
+			buf.WriteString("\n")
+		}
+	} else {
+		buf.WriteString("127.0.0.1\tlocalhost\n")
+		buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+		buf.WriteString("fe00::0\tip6-localnet\n")
+		buf.WriteString("ff00::0\tip6-mcastprefix\n")
+		buf.WriteString("ff02::1\tip6-allnodes\n")
+		buf.WriteString("ff02::2\tip6-allrouters\n")
+	}
+	if containerIP != "" {
+		buf.WriteString(fmt.Sprintf("%s\t%s\n", containerIP, hostname))
+	}
+	for _, extraHost := range extraHosts {
+		// ip 可能是 IPv6 地址，因此只按第一个冒号分割
+		host, ip, found := strings.Cut(extraHost, ":")
+		if !found || host == "" || net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid add-host [%s], must be host:ip", extraHost)
+		}
+		buf.WriteString(fmt.Sprintf("%s\t%s\n", ip, host))
+	}
+	return buf.Bytes(), nil
+}
+
+// buildResolvConf 根据宿主机的 resolv.conf 生成容器的 resolv.conf
+/*
+宿主机上的 127.0.0.53(systemd-resolved) 等本地回环地址在容器的 Net Namespace 中是访问不到的，因此需要过滤掉(filterLoopback)。
+指定了 --dns、--dns-search 时会替换掉宿主机对应的配置，其他配置(比如 options)保持不变。
+*/
+func buildResolvConf(hostResolv []byte, filterLoopback bool, dnsConfig *DNSConfig) []byte {
+	var (
+		nameservers []string
+		search      []string
+		others      []string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(hostResolv))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) > 1 && !(filterLoopback && isLoopback(fields[1])) {
+				nameservers = append(nameservers, fields[1])
+			}
+		case "search", "domain":
+			search = fields[1:]
+		default:
+			others = append(others, line)
+		}
+	}
+	if len(dnsConfig.Nameservers) > 0 {
+		nameservers = dnsConfig.Nameservers
+	}
+	if len(nameservers) == 0 {
+		nameservers = defaultNameservers
+	}
+	if len(dnsConfig.Search) > 0 {
+		search = dnsConfig.Search
+	}
+
+	var buf bytes.Buffer
+	if len(search) > 0 {
+		buf.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	for _, ns := range nameservers {
+		buf.WriteString("nameserver " + ns + "\n")
+	}
+	for _, line := range others {
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes()
+}
+
+func isLoopback(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,55 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildResolvConf(t *testing.T) {
+	hostResolv := []byte(`# generated by systemd-resolved
+nameserver 127.0.0.53
+nameserver 10.0.0.2
+nameserver ::1
+search corp.local
+options edns0 trust-ad
+`)
+	resolv := string(buildResolvConf(hostResolv, true, &DNSConfig{}))
+	t.Logf("resolv.conf:\n%s", resolv)
+	if strings.Contains(resolv, "127.0.0.53") || strings.Contains(resolv, "::1") {
+		t.Fatalf("loopback nameserver should be filtered")
+	}
+	for _, expect := range []string{"nameserver 10.0.0.2", "search corp.local", "options edns0 trust-ad"} {
+		if !strings.Contains(resolv, expect) {
+			t.Fatalf("resolv.conf should contain %q", expect)
+		}
+	}
+
+	resolv = string(buildResolvConf(hostResolv, true, &DNSConfig{
+		Nameservers: []string{"114.114.114.114"},
+		Search:      []string{"example.com"},
+	}))
+	if strings.Contains(resolv, "10.0.0.2") || strings.Contains(resolv, "corp.local") {
+		t.Fatalf("--dns and --dns-search should replace host config, got:\n%s", resolv)
+	}
+
+	// 只有本地回环 DNS 时使用默认 DNS
+	resolv = string(buildResolvConf([]byte("nameserver 127.0.0.53\n"), true, &DNSConfig{}))
+	if !strings.Contains(resolv, "nameserver 8.8.8.8") {
+		t.Fatalf("should fall back to default nameservers, got:\n%s", resolv)
+	}
+}
+
+func TestBuildHosts(t *testing.T) {
+	hosts, err := buildHosts(nil, "web", "172.18.0.2", []string{"db:10.0.0.3", "v6:fd00::1"})
+	if err != nil {
+		t.Fatalf("build hosts %v", err)
+	}
+	for _, expect := range []string{"172.18.0.2\tweb\n", "10.0.0.3\tdb\n", "fd00::1\tv6\n"} {
+		if !strings.Contains(string(hosts), expect) {
+			t.Fatalf("hosts should contain %q, got:\n%s", expect, hosts)
+		}
+	}
+	if _, err = buildHosts(nil, "web", "", []string{"bad"}); err == nil {
+		t.Fatalf("invalid add-host should fail")
+	}
+}
@@ -1,14 +1,18 @@
 package container
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 	"io"
+	"mydocker/constant"
+	"mydocker/network"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"runtime"
 	"syscall"
 )
 
@@ -19,7 +23,47 @@ func RunContainerInitProcess() error {
 		return errors.New("run container get user command error, cmdArray is nil")
 	}
 
-	setUpMount()
+	containerId := os.Getenv(EnvContainerId)
+	hostname := os.Getenv(EnvHostname)
+	netNsPath := os.Getenv(EnvNetNs)
+	netMode := os.Getenv(EnvNetMode)
+	workingDir := os.Getenv(EnvWorkingDir)
+	_ = os.Unsetenv(EnvContainerId)
+	_ = os.Unsetenv(EnvHostname)
+	_ = os.Unsetenv(EnvNetNs)
+	_ = os.Unsetenv(EnvNetMode)
+	_ = os.Unsetenv(EnvWorkingDir)
+
+	switch netMode {
+	case NetModeContainer:
+		if err := joinNetNs(netNsPath); err != nil {
+			return err
+		}
+	case NetModeNone, NetModeBridge, NetModeMacvlan, NetModeIpvlan, NetModeCNI:
+		// 新建的 Net Namespace 中 lo 默认是 down 的，很多程序依赖 127.0.0.1，这里统一启动 lo
+		if err := network.SetupLoopback(); err != nil {
+			log.Errorf("Setup loopback error %v", err)
+		}
+	}
+
+	// init 进程运行在新的 UTS Namespace 中，设置主机名不会影响宿主机
+	if hostname != "" {
+		if err := unix.Sethostname([]byte(hostname)); err != nil {
+			log.Errorf("Set hostname %s error %v", hostname, err)
+		}
+	}
+
+	setUpMount(containerId)
+
+	// 镜像中不存在工作目录时自动创建
+	if workingDir != "" {
+		if err := os.MkdirAll(workingDir, constant.Perm0755); err != nil {
+			log.Errorf("Mkdir working dir %s error %v", workingDir, err)
+		}
+		if err := unix.Chdir(workingDir); err != nil {
+			return errors.Wrapf(err, "chdir to %s", workingDir)
+		}
+	}
 
 	path, err := exec.LookPath(cmdArray[0]) // 找到对应的shell
 	if err != nil {
@@ -35,6 +79,24 @@ func RunContainerInitProcess() error {
 	return nil
 }
 
+// joinNetNs 加入指定的 Net Namespace，用于 container 网络模式
+/*
+Namespace 是线程级别的，setns 只会修改当前线程，因此这里锁定当前线程并且不再解锁，
+后续的 syscall.Exec 也会在这个线程上执行，exec 之后用户进程就运行在目标 Net Namespace 中了。
+*/
+func joinNetNs(netNsPath string) error {
+	f, err := os.Open(netNsPath)
+	if err != nil {
+		return errors.Wrapf(err, "open netns %s", netNsPath)
+	}
+	defer f.Close()
+	runtime.LockOSThread()
+	if err = unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+		return errors.Wrapf(err, "setns %s", netNsPath)
+	}
+	return nil
+}
+
 const fdIndex = 3 // 带过来的第一个FD
 
 func readUserCommand() []string {
@@ -52,16 +114,29 @@ func readUserCommand() []string {
 	*/
 	pipe := os.NewFile(uintptr(fdIndex), "pipe")
 	defer pipe.Close()
-	msg, err := io.ReadAll(pipe)
+	cmdArray, err := decodeUserCommand(pipe)
 	if err != nil {
 		log.Errorf("init read pipe error %v", err)
 		return nil
 	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	return cmdArray
+}
+
+// WriteUserCommand 将用户命令写入管道，命令编码为 json 数组，参数中的空格不会被拆开
+func WriteUserCommand(w io.Writer, cmdArray []string) error {
+	return errors.Wrap(json.NewEncoder(w).Encode(cmdArray), "encode user command")
+}
+
+// decodeUserCommand 读取 WriteUserCommand 写入的用户命令
+func decodeUserCommand(r io.Reader) ([]string, error) {
+	var cmdArray []string
+	if err := json.NewDecoder(r).Decode(&cmdArray); err != nil {
+		return nil, errors.Wrap(err, "decode user command")
+	}
+	return cmdArray, nil
 }
 
-func setUpMount() {
+func setUpMount(containerId string) {
 	pwd, err := os.Getwd()
 	if err != nil {
 		log.Errorf("Get current location error %v", err)
@@ -75,6 +150,9 @@ func setUpMount() {
 	// 如果不先做 private mount，会导致挂载事件外泄，后续执行 pivotRoot 会出现 invalid argument 错误
 	err = unix.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, "")
 
+	// 在 pivotRoot 之前把生成的 hosts、hostname、resolv.conf 挂载到 rootfs 中，此时还能访问到宿主机上的容器信息目录
+	mountEtcFiles(pwd, containerId)
+
 	err = pivotRoot(pwd)
 	if err != nil {
 		log.Errorf("pivotRoot failed,detail: %v", err)
@@ -90,6 +168,38 @@ func setUpMount() {
 	unix.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
 }
 
+// mountEtcFiles 将容器信息目录下生成的 /etc 文件 bind mount 到 rootfs 中，覆盖镜像中自带的文件
+func mountEtcFiles(root, containerId string) {
+	if containerId == "" {
+		return
+	}
+	dirPath := fmt.Sprintf(InfoLocFormat, containerId)
+	for _, name := range etcFiles {
+		source := filepath.Join(dirPath, name)
+		if _, err := os.Stat(source); err != nil {
+			continue
+		}
+		// bind mount 的目标文件必须存在，镜像中没有时创建一个空文件
+		target := filepath.Join(root, "etc", name)
+		if err := os.MkdirAll(filepath.Dir(target), constant.Perm0755); err != nil {
+			log.Errorf("mkdir %s error %v", filepath.Dir(target), err)
+			continue
+		}
+		// 镜像中的文件可能是指向其他位置的软链接，bind mount 会跟随软链接，这里直接替换成普通文件
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			_ = os.Remove(target)
+		}
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if f, err := os.Create(target); err == nil {
+				_ = f.Close()
+			}
+		}
+		if err := unix.Mount(source, target, "bind", syscall.MS_BIND, ""); err != nil {
+			log.Errorf("bind mount %s to %s error %v", source, target, err)
+		}
+	}
+}
+
 func pivotRoot(root string) error {
 	/**
 	  NOTE：PivotRoot调用有限制，newRoot和oldRoot不能在同一个文件系统下。
@@ -0,0 +1,36 @@
+package container
+
+import (
+	"mydocker/image"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUserCommandRoundTrip(t *testing.T) {
+	config := &image.ContainerConfig{}
+	if err := config.ApplyChange(`CMD ["sh", "-c", "echo hello  world"]`); err != nil {
+		t.Fatalf("apply change %v", err)
+	}
+	for _, cmdArray := range [][]string{
+		config.Command(nil),
+		{"/bin/echo", "", "a\tb", "quote\"d"},
+	} {
+		readPipe, writePipe, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("pipe %v", err)
+		}
+		if err = WriteUserCommand(writePipe, cmdArray); err != nil {
+			t.Fatalf("write user command %v", err)
+		}
+		_ = writePipe.Close()
+		got, err := decodeUserCommand(readPipe)
+		_ = readPipe.Close()
+		if err != nil {
+			t.Fatalf("decode user command %v", err)
+		}
+		if !reflect.DeepEqual(got, cmdArray) {
+			t.Fatalf("expect %q, got %q", cmdArray, got)
+		}
+	}
+}
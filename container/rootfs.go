@@ -2,15 +2,17 @@ package container
 
 import (
 	log "github.com/sirupsen/logrus"
+	"mydocker/image"
 	"mydocker/utils"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 func NewWorkSpace(containerID, imageName, volume string) {
-	createLower(containerID, imageName)
+	lowerDirs := createLower(containerID, imageName)
 	createDirs(containerID)
-	mountOverlayFS(containerID)
+	mountOverlayFS(containerID, lowerDirs)
 
 	if volume != "" {
 		mntPath := utils.GetMerged(containerID)
@@ -23,25 +25,22 @@ func NewWorkSpace(containerID, imageName, volume string) {
 	}
 }
 
-// createLower 将busybox作为overlayfs的lower层
-func createLower(containerID, imageName string) {
-	// 把busybox作为overlayfs中的lower层
-	lowerPath := utils.GetLower(containerID)
-	imagePath := utils.GetImage(imageName)
-	log.Infof("lower:%s image.tar:%s", lowerPath, imagePath)
-	exist, err := utils.PathExists(lowerPath)
+// createLower 获取镜像解压后的只读层作为overlayfs的lower层
+// 同一个镜像的层只会解压一次，所有容器共享，返回的多个目录用冒号分隔
+func createLower(containerID, imageName string) string {
+	img, err := image.DefaultStore.Get(imageName)
 	if err != nil {
-		log.Infof("Fail to judge whether dir %s exists. %v", lowerPath, err)
+		log.Errorf("Get image %s error %v", imageName, err)
+		return ""
 	}
-
-	if !exist {
-		if err = os.MkdirAll(lowerPath, 0777); err != nil {
-			log.Errorf("Mkdir dir %s error. %v", lowerPath, err)
-		}
-		if _, err = exec.Command("tar", "-xvf", imagePath, "-C", lowerPath).CombinedOutput(); err != nil {
-			log.Errorf("Untar dir %s error %v", lowerPath, err)
-		}
+	layerDirs, err := image.DefaultStore.LayerDirs(img, containerID)
+	if err != nil {
+		log.Errorf("Prepare layers of image %s error %v", imageName, err)
+		return ""
 	}
+	lowerDirs := strings.Join(layerDirs, ":")
+	log.Infof("lower:%s image:%s", lowerDirs, image.ShortID(img.ID))
+	return lowerDirs
 }
 
 // createDirs 创建overlayfs需要的的merged、upper、worker目录
@@ -53,7 +52,7 @@ func createDirs(containerID string) {
 	}
 
 	for _, dir := range dirs {
-		if err := os.Mkdir(dir, 0777); err != nil {
+		if err := os.MkdirAll(dir, 0777); err != nil {
 			log.Errorf("mkdir dir %s error. %v", dir, err)
 		}
 	}
@@ -76,10 +75,10 @@ func deleteDirs(containerID string) {
 }
 
 // mountOverlayFS 挂载overlayfs
-func mountOverlayFS(containerID string) {
+func mountOverlayFS(containerID, lowerDirs string) {
 	// 拼接参数
 	// e.g. lowerdir=/root/busybox,upperdir=/root/upper,workdir=/root/work
-	dirs := utils.GetOverlayFSDirs(utils.GetLower(containerID), utils.GetUpper(containerID), utils.GetWorker(containerID))
+	dirs := utils.GetOverlayFSDirs(lowerDirs, utils.GetUpper(containerID), utils.GetWorker(containerID))
 	mergedPath := utils.GetMerged(containerID)
 	// 完整命令：mount -t overlay overlay -o lowerdir=/root/busybox,upperdir=/root/upper,workdir=/root/work /root/merged
 	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o", dirs, mergedPath)
@@ -116,4 +115,7 @@ func DeleteWorkSpace(containerID string, volume string) {
 	}
 	umountOverlayFS(containerID)
 	deleteDirs(containerID)
+	if err := image.DefaultStore.ReleaseContainer(containerID); err != nil {
+		log.Errorf("Release layers of container %s error %v", containerID, err)
+	}
 }
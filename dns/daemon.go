@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"mydocker/constant"
+	"mydocker/utils"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// pidDir 每个网络的 DNS 服务器进程 PID 文件以及日志存放目录
+const pidDir = "/var/lib/mydocker/network/dns/"
+
+// Start 为网络启动 DNS 服务器进程，已经在运行时直接返回
+/*
+DNS 服务器进程是通过 /proc/self/exe dns 启动的 mydocker 自身，运行在单独的 session 中，
+直到网络被删除时才通过 Stop 停止。
+同一个网络的多个容器可能同时启动，检查和启动都在文件锁中进行，并且等到 DNS 进程开始监听后才返回。
+*/
+func Start(networkName, listenAddr string) error {
+	if err := os.MkdirAll(pidDir, constant.Perm0755); err != nil {
+		return errors.Wrapf(err, "mkdir %s", pidDir)
+	}
+	lockFile, err := os.OpenFile(path.Join(pidDir, networkName+".lock"), os.O_CREATE|os.O_RDWR, constant.Perm0644)
+	if err != nil {
+		return errors.Wrapf(err, "open lock file of dns %s", networkName)
+	}
+	defer lockFile.Close()
+	if err = unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "lock dns %s", networkName)
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	if IsRunning(networkName) {
+		return nil
+	}
+	logFile, err := os.OpenFile(path.Join(pidDir, networkName+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, constant.Perm0644)
+	if err != nil {
+		return errors.Wrapf(err, "open log file of dns %s", networkName)
+	}
+	defer logFile.Close()
+	cmd := exec.Command("/proc/self/exe", "dns", "-network", networkName, "-listen", listenAddr)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err = utils.StartAndWaitReady(cmd, utils.ReadyTimeout); err != nil {
+		return errors.WithMessagef(err, "dns log %s", logFile.Name())
+	}
+	pidFile := path.Join(pidDir, networkName+".pid")
+	if err = os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), constant.Perm0644); err != nil {
+		_ = cmd.Process.Kill()
+		return errors.Wrapf(err, "write pid file %s", pidFile)
+	}
+	return cmd.Process.Release()
+}
+
+// Stop 停止网络的 DNS 服务器进程
+func Stop(networkName string) {
+	if pid, running := daemonPid(networkName); running {
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Errorf("kill dns of network %s error %v", networkName, err)
+			return
+		}
+	}
+	_ = os.Remove(path.Join(pidDir, networkName+".pid"))
+}
+
+// IsRunning 判断网络的 DNS 服务器进程是否还在运行
+func IsRunning(networkName string) bool {
+	_, running := daemonPid(networkName)
+	return running
+}
+
+// daemonPid 读取网络的 DNS 服务器进程 PID，并判断进程是否还在运行
+/*
+DNS 进程崩溃后 PID 可能被其他进程复用，只检查进程是否存在会把其他进程当成 DNS 进程，
+因此还要检查 /proc/<pid>/cmdline 是否是这个网络的 dns 命令。
+*/
+func daemonPid(networkName string) (int, bool) {
+	pid, err := readPid(networkName)
+	if err != nil {
+		return 0, false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return pid, false
+	}
+	return pid, isDaemonCmdline(strings.Split(string(cmdline), "\x00"), networkName)
+}
+
+// isDaemonCmdline 判断进程参数是否是 Start 启动的 dns 命令: /proc/self/exe dns -network <name> ...
+func isDaemonCmdline(args []string, networkName string) bool {
+	if len(args) < 4 || args[1] != "dns" {
+		return false
+	}
+	for i := 2; i < len(args)-1; i++ {
+		if args[i] == "-network" && args[i+1] == networkName {
+			return true
+		}
+	}
+	return false
+}
+
+func readPid(networkName string) (int, error) {
+	content, err := os.ReadFile(path.Join(pidDir, networkName+".pid"))
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file of dns %s", networkName)
+	}
+	return pid, nil
+}
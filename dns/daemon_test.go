@@ -0,0 +1,20 @@
+package dns
+
+import "testing"
+
+func TestIsDaemonCmdline(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		expect bool
+	}{
+		{[]string{"/proc/self/exe", "dns", "-network", "mynet", "-listen", "10.20.0.1:53", ""}, true},
+		{[]string{"/proc/self/exe", "dns", "-network", "other", "-listen", "10.20.0.1:53", ""}, false},
+		// PID 被其他进程复用
+		{[]string{"sleep", "300", ""}, false},
+		{[]string{"/proc/self/exe", "init", "-network", "mynet", ""}, false},
+	} {
+		if got := isDaemonCmdline(c.args, "mynet"); got != c.expect {
+			t.Fatalf("%q: expect %v, got %v", c.args, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"mydocker/container"
+	"mydocker/utils"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPort    = 53
+	hostResolvConf = "/etc/resolv.conf"
+	// answerTTL 容器随时可能被删除重建，TTL 设置得短一些
+	answerTTL      = 10
+	forwardTimeout = 3 * time.Second
+	maxPacketSize  = 65535
+)
+
+// Server 网络内置的 DNS 服务器
+/*
+监听在网络的网关地址上，容器的 resolv.conf 指向网关地址。
+对于连接在同一网络上的容器名、别名以及容器 Id 的 A/AAAA 查询直接根据容器信息目录中的容器信息应答，
+其他查询原样转发给宿主机的上游 DNS。
+*/
+type Server struct {
+	Network   string   // 只解析连接在该网络上的容器
+	InfoLoc   string   // 容器信息目录，默认为 container.InfoLoc
+	Upstreams []string // 上游 DNS 地址，格式为 ip:port
+}
+
+// NewServer 创建网络的 DNS 服务器，上游 DNS 使用宿主机 resolv.conf 中的配置
+func NewServer(networkName string) *Server {
+	return &Server{
+		Network:   networkName,
+		InfoLoc:   container.InfoLoc,
+		Upstreams: hostUpstreams(),
+	}
+}
+
+// ListenAndServe 监听 UDP 地址并提供服务，阻塞直到出错
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listen udp %s", addr)
+	}
+	// 开始监听后通知启动 DNS 进程的 mydocker
+	utils.NotifyReady()
+	return s.Serve(conn)
+}
+
+// Serve 在已经监听的连接上提供服务，每个请求在单独的 goroutine 中处理，避免转发请求阻塞其他查询
+func (s *Server) Serve(conn net.PacketConn) error {
+	defer conn.Close()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return errors.Wrap(err, "read udp")
+		}
+		req := make([]byte, n)
+		copy(req, buf[:n])
+		go func() {
+			resp := s.handle(req)
+			if resp == nil {
+				return
+			}
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				log.Errorf("write dns response to %s error %v", addr, err)
+			}
+		}()
+	}
+}
+
+// handle 处理一个 DNS 请求，返回 nil 表示丢弃该请求
+func (s *Server) handle(req []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(req)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		return s.reply(header, questions, dnsmessage.RCodeFormatError, nil)
+	}
+	q := questions[0]
+	if q.Class == dnsmessage.ClassINET {
+		if ips, found := s.lookup(q.Name.String()); found {
+			return s.reply(header, questions, dnsmessage.RCodeSuccess, answers(q, ips))
+		}
+	}
+	resp, err := s.forward(req)
+	if err != nil {
+		log.Errorf("forward dns query %s error %v", q.Name.String(), err)
+		return s.reply(header, questions, dnsmessage.RCodeServerFailure, nil)
+	}
+	return resp
+}
+
+// answers 根据查询类型生成应答记录，名字存在但没有对应类型的地址时返回空应答
+func answers(q dnsmessage.Question, ips []net.IP) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	for _, ip := range ips {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: answerTTL}
+		switch {
+		case q.Type == dnsmessage.TypeA && ip.To4() != nil:
+			var a dnsmessage.AResource
+			copy(a.A[:], ip.To4())
+			rrs = append(rrs, dnsmessage.Resource{Header: rh, Body: &a})
+		case q.Type == dnsmessage.TypeAAAA && ip.To4() == nil && ip.To16() != nil:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			rrs = append(rrs, dnsmessage.Resource{Header: rh, Body: &aaaa})
+		}
+	}
+	return rrs
+}
+
+func (s *Server) reply(reqHeader dnsmessage.Header, questions []dnsmessage.Question, rcode dnsmessage.RCode,
+	rrs []dnsmessage.Resource) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 reqHeader.ID,
+			Response:           true,
+			OpCode:             reqHeader.OpCode,
+			Authoritative:      rcode == dnsmessage.RCodeSuccess,
+			RecursionDesired:   reqHeader.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: questions,
+		Answers:   rrs,
+	}
+	resp, err := msg.Pack()
+	if err != nil {
+		log.Errorf("pack dns response error %v", err)
+		return nil
+	}
+	return resp
+}
+
+// lookup 在连接到当前网络的运行中容器里查找名字，匹配容器名、别名以及容器 Id，不区分大小写
+func (s *Server) lookup(name string) ([]net.IP, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	files, err := os.ReadDir(s.InfoLoc)
+	if err != nil {
+		return nil, false
+	}
+	for _, file := range files {
+		info, err := readContainerInfo(path.Join(s.InfoLoc, file.Name(), container.ConfigName))
+		if err != nil || info.Status != container.RUNNING || info.NetworkName != s.Network {
+			continue
+		}
+		if !matchContainer(info, name) {
+			continue
+		}
+		var ips []net.IP
+		if ip := net.ParseIP(info.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+		if ip, _, err := net.ParseCIDR(info.IPv6); err == nil {
+			ips = append(ips, ip)
+		}
+		return ips, true
+	}
+	return nil, false
+}
+
+func matchContainer(info *container.Info, name string) bool {
+	if strings.EqualFold(info.Name, name) || strings.EqualFold(info.Id, name) {
+		return true
+	}
+	for _, alias := range info.Aliases {
+		if strings.EqualFold(alias, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func readContainerInfo(configPath string) (*container.Info, error) {
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	info := new(container.Info)
+	if err = json.Unmarshal(content, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// forward 依次尝试上游 DNS，返回第一个成功的应答
+func (s *Server) forward(req []byte) ([]byte, error) {
+	if len(s.Upstreams) == 0 {
+		return nil, errors.New("no upstream dns server")
+	}
+	var lastErr error
+	buf := make([]byte, maxPacketSize)
+	for _, upstream := range s.Upstreams {
+		resp, err := func() ([]byte, error) {
+			conn, err := net.DialTimeout("udp", upstream, forwardTimeout)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(forwardTimeout))
+			if _, err = conn.Write(req); err != nil {
+				return nil, err
+			}
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			return buf[:n], nil
+		}()
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = errors.Wrapf(err, "upstream %s", upstream)
+	}
+	return nil, lastErr
+}
+
+// hostUpstreams 读取宿主机 resolv.conf 中的 nameserver 作为上游 DNS
+// DNS 服务器运行在宿主机的 Net Namespace 中，因此 127.0.0.53 这样的本地地址也可以使用
+func hostUpstreams() []string {
+	f, err := os.Open(hostResolvConf)
+	if err != nil {
+		log.Errorf("open %s error %v", hostResolvConf, err)
+		return nil
+	}
+	defer f.Close()
+	var upstreams []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			upstreams = append(upstreams, net.JoinHostPort(ip.String(), fmt.Sprint(DefaultPort)))
+		}
+	}
+	return upstreams
+}
@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"encoding/json"
+	"golang.org/x/net/dns/dnsmessage"
+	"mydocker/container"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeContainer(t *testing.T, infoLoc string, info *container.Info) {
+	dir := path.Join(infoLoc, info.Id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdir %v", err)
+	}
+	content, _ := json.Marshal(info)
+	if err := os.WriteFile(path.Join(dir, container.ConfigName), content, 0644); err != nil {
+		t.Fatalf("write container info %v", err)
+	}
+}
+
+// startUpstream 启动一个假的上游 DNS，对所有 A 查询都返回 1.2.3.4
+func startUpstream(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen upstream %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err = req.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true},
+				Questions: req.Questions,
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: req.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+					Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+				}},
+			}
+			packed, _ := resp.Pack()
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startServer(t *testing.T, s *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen %v", err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func query(t *testing.T, server, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatalf("pack %v", err)
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		t.Fatalf("dial %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(packed); err != nil {
+		t.Fatalf("write %v", err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read %v", err)
+	}
+	var resp dnsmessage.Message
+	if err = resp.Unpack(buf[:n]); err != nil {
+		t.Fatalf("unpack %v", err)
+	}
+	if resp.ID != req.ID {
+		t.Fatalf("response id %d mismatch", resp.ID)
+	}
+	return &resp
+}
+
+func answerA(t *testing.T, resp *dnsmessage.Message) string {
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Fatalf("expect one answer, got rcode %v answers %v", resp.RCode, resp.Answers)
+	}
+	a, ok := resp.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok {
+		t.Fatalf("expect A record, got %v", resp.Answers[0].Body)
+	}
+	return net.IP(a.A[:]).String()
+}
+
+func TestServerResolveContainer(t *testing.T) {
+	infoLoc := t.TempDir()
+	writeContainer(t, infoLoc, &container.Info{Id: "1111111111", Name: "web", Status: container.RUNNING,
+		NetworkName: "testnet", IP: "10.20.0.2", Aliases: []string{"frontend"}})
+	writeContainer(t, infoLoc, &container.Info{Id: "2222222222", Name: "db", Status: container.RUNNING,
+		NetworkName: "othernet", IP: "10.30.0.2"})
+	writeContainer(t, infoLoc, &container.Info{Id: "3333333333", Name: "old", Status: container.STOP,
+		NetworkName: "testnet", IP: "10.20.0.3"})
+
+	server := startServer(t, &Server{Network: "testnet", InfoLoc: infoLoc, Upstreams: []string{startUpstream(t)}})
+
+	for _, name := range []string{"web.", "WEB.", "frontend.", "1111111111."} {
+		if ip := answerA(t, query(t, server, name, dnsmessage.TypeA)); ip != "10.20.0.2" {
+			t.Fatalf("%s should resolve to 10.20.0.2, got %s", name, ip)
+		}
+	}
+	// 已知名字没有 IPv6 地址时返回空应答，而不是转发
+	resp := query(t, server, "web.", dnsmessage.TypeAAAA)
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Fatalf("AAAA of web should be empty, got rcode %v answers %v", resp.RCode, resp.Answers)
+	}
+	// 其他网络以及已停止的容器都交给上游处理
+	for _, name := range []string{"db.", "old.", "example.com."} {
+		if ip := answerA(t, query(t, server, name, dnsmessage.TypeA)); ip != "1.2.3.4" {
+			t.Fatalf("%s should be forwarded to upstream, got %s", name, ip)
+		}
+	}
+}
+
+func TestServerUpstreamFailure(t *testing.T) {
+	// 找一个没有监听的端口作为上游
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	deadUpstream := conn.LocalAddr().String()
+	_ = conn.Close()
+
+	server := startServer(t, &Server{Network: "testnet", InfoLoc: t.TempDir(), Upstreams: []string{deadUpstream}})
+	resp := query(t, server, "example.com.", dnsmessage.TypeA)
+	if resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("expect SERVFAIL, got %v", resp.RCode)
+	}
+}
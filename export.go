@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"mydocker/image"
+	"mydocker/utils"
+	"os"
+	"path/filepath"
+)
+
+// exportContainer 将容器的完整文件系统导出为 tar，运行中和已经停止的容器都可以导出
+// 挂载到容器中的 volume 不会被导出，output 为 - 时写到标准输出，此时日志改为输出到标准错误
+func exportContainer(containerID, output string) (err error) {
+	if output == "-" {
+		log.SetOutput(os.Stderr)
+	}
+	if _, err = getInfoByContainerId(containerID); err != nil {
+		return err
+	}
+	mntPath := utils.GetMerged(containerID)
+	mounted, err := isMountPoint(mntPath)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("filesystem of container %s is not mounted", containerID)
+	}
+	if output == "-" {
+		if err = image.WriteRootfs(os.Stdout, mntPath); err != nil {
+			return errors.WithMessagef(err, "export container %s", containerID)
+		}
+		return nil
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	// 写入或者关闭失败时删除不完整的文件
+	defer func() {
+		if closeErr := f.Close(); err == nil && closeErr != nil {
+			err = errors.Wrapf(closeErr, "close %s", output)
+		}
+		if err != nil {
+			_ = os.Remove(output)
+		}
+	}()
+	if err = image.WriteRootfs(f, mntPath); err != nil {
+		return errors.WithMessagef(err, "export container %s", containerID)
+	}
+	log.Infof("export container %s to %s", containerID, output)
+	return nil
+}
+
+// importImage 将 rootfs 压缩包导入为新镜像，input 为 - 时从标准输入读取
+// 镜像配置为空，可以通过 changes 设置 CMD、ENV 等
+func importImage(input, ref string, changes []string) error {
+	config := &image.ContainerConfig{}
+	for _, change := range changes {
+		if err := config.ApplyChange(change); err != nil {
+			return err
+		}
+	}
+	f := os.Stdin
+	if input != "-" {
+		var err error
+		if f, err = os.Open(input); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	img, err := image.DefaultStore.Import(ref, f, config)
+	if err != nil {
+		return errors.WithMessagef(err, "import %s", input)
+	}
+	fmt.Println(img.ID)
+	return nil
+}
+
+// isMountPoint 和父目录的设备号不同时说明 dir 上挂载了其他文件系统
+func isMountPoint(dir string) (bool, error) {
+	var stat, parentStat unix.Stat_t
+	if err := unix.Stat(dir, &stat); err != nil {
+		return false, errors.Wrapf(err, "stat %s", dir)
+	}
+	if err := unix.Stat(filepath.Dir(dir), &parentStat); err != nil {
+		return false, errors.Wrapf(err, "stat %s", filepath.Dir(dir))
+	}
+	return stat.Dev != parentStat.Dev, nil
+}
@@ -6,7 +6,10 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.9.3
 	github.com/urfave/cli v1.22.16
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
+	github.com/vishvananda/netlink v1.3.1
+	github.com/vishvananda/netns v0.0.5
+	golang.org/x/net v0.12.0
+	golang.org/x/sys v0.10.0
 )
 
 require (
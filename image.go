@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"mydocker/image"
+	"os"
+	"text/tabwriter"
+)
+
+// listImages 打印本地所有镜像
+func listImages() error {
+	summaries, err := image.DefaultStore.List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	_, _ = fmt.Fprint(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\n")
+	for _, item := range summaries {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			item.Name,
+			item.Tag,
+			image.ShortID(item.Image.ID),
+			item.Image.Created.Format("2006-01-02 15:04:05"),
+			formatSize(item.Image.Size))
+	}
+	if err = w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+	return nil
+}
+
+// removeImage 删除镜像，镜像被容器使用时除非指定 force 否则拒绝删除
+// 镜像还有其他引用时只删除引用，不会影响使用该镜像的容器
+func removeImage(ref string, force bool) error {
+	img, err := image.DefaultStore.Get(ref)
+	if err != nil {
+		return err
+	}
+	refs, err := image.DefaultStore.References(img.ID)
+	if err != nil {
+		return err
+	}
+	untagOnly := len(refs) > 1 && containsString(refs, normalizeReference(ref))
+	if !untagOnly && !force {
+		users, err := getImageContainers(img.ID)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			return fmt.Errorf("image %s is being used by container(s) %v, remove them or use -f", ref, users)
+		}
+	}
+	removed, err := image.DefaultStore.Remove(ref)
+	if err != nil {
+		return err
+	}
+	if removed == nil {
+		fmt.Printf("Untagged: %s\n", normalizeReference(ref))
+		return nil
+	}
+	fmt.Printf("Deleted: %s\n", removed.ID)
+	return nil
+}
+
+// pruneImages 删除所有没有被容器使用的镜像，并打印释放的空间
+func pruneImages() error {
+	containers, err := getAllContainerInfo()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool, len(containers))
+	for _, info := range containers {
+		used[info.ImageID] = true
+	}
+	removed, err := image.DefaultStore.Prune(func(img *image.Image) bool {
+		return used[img.ID]
+	})
+	var reclaimed int64
+	for _, img := range removed {
+		fmt.Printf("Deleted: %s\n", img.ID)
+		reclaimed += img.Size
+	}
+	fmt.Printf("Total reclaimed space: %s\n", formatSize(reclaimed))
+	return err
+}
+
+// loadImages 导入 docker save 归档或者 OCI 镜像布局，打印导入的镜像
+func loadImages(input, ref string) error {
+	loaded, err := image.DefaultStore.Load(input, ref)
+	for _, item := range loaded {
+		if item.Name == "" {
+			fmt.Printf("Loaded image ID: %s\n", item.Image.ID)
+			continue
+		}
+		fmt.Printf("Loaded image: %s:%s\n", item.Name, item.Tag)
+	}
+	return err
+}
+
+// saveImages 将镜像导出为 OCI 镜像布局格式的 tar，导出失败时删除输出文件
+func saveImages(output string, refs []string) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = image.DefaultStore.Save(f, refs...); err != nil {
+		_ = os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+// getImageContainers 返回使用镜像的所有容器，包括已经停止的容器
+func getImageContainers(imageID string) ([]string, error) {
+	containers, err := getAllContainerInfo()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, info := range containers {
+		if info.ImageID == imageID {
+			ids = append(ids, info.Id)
+		}
+	}
+	return ids, nil
+}
+
+// normalizeReference 补全镜像引用中省略的 tag，不是合法引用时原样返回
+func normalizeReference(ref string) string {
+	name, tag, err := image.ParseReference(ref)
+	if err != nil {
+		return ref
+	}
+	return name + ":" + tag
+}
+
+func containsString(items []string, target string) bool {
+	for _, item := range items {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
+
+// formatSize 将字节数转换为 KB、MB 等便于阅读的格式
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
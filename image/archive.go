@@ -0,0 +1,392 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"mydocker/constant"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// OCI 层中的 whiteout 文件，.wh.<name> 表示删除下层的 <name>，.wh..wh..opq 表示所在目录不继承下层的内容
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+	// overlayfs 自己使用的扩展属性前缀，以及标记 opaque 目录的扩展属性
+	overlayXattrPrefix = "trusted.overlay."
+	overlayOpaqueXattr = overlayXattrPrefix + "opaque"
+	// PAX 格式中保存扩展属性的记录前缀
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// WriteLayer 将 overlayfs 的 upper 目录打包为 OCI 格式的层
+/*
+upper 目录中 overlayfs 用来表示删除的 whiteout 会被转换为 OCI 的 whiteout 文件:
+- 设备号为 0:0 的字符设备 <name> 转换为空文件 .wh.<name>
+- 带有 trusted.overlay.opaque=y 扩展属性的目录，在目录下添加空文件 .wh..wh..opq
+excludes 中相对于 dir 的路径不会被打包。
+*/
+func WriteLayer(w io.Writer, dir string, excludes ...string) error {
+	return writeTar(w, dir, true, excludes)
+}
+
+// WriteRootfs 将容器 merged 目录中的完整文件系统打包为 tar，export 使用
+func WriteRootfs(w io.Writer, dir string) error {
+	return writeTar(w, dir, false, nil)
+}
+
+// writeTar 打包 dir，whiteout 为 true 时转换 overlayfs 的 whiteout，excludes 中的路径会被跳过
+// 和 tar --one-file-system 一样不会进入挂载到 dir 中的其他文件系统，例如 volume，只保留挂载点的空目录
+func writeTar(w io.Writer, dir string, whiteout bool, excludes []string) error {
+	var rootStat unix.Stat_t
+	if err := unix.Stat(dir, &rootStat); err != nil {
+		return errors.Wrapf(err, "stat %s", dir)
+	}
+	tw := tar.NewWriter(w)
+	// 硬链接只打包第一次出现的文件，之后的作为指向它的链接
+	hardlinks := make(map[uint64]string)
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, filePath)
+		if err != nil || name == "." {
+			return err
+		}
+		if containsString(excludes, name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		stat, _ := info.Sys().(*syscall.Stat_t)
+		otherFS := stat != nil && stat.Dev != rootStat.Dev
+		if otherFS && !info.IsDir() {
+			return nil
+		}
+		if whiteout && info.Mode()&os.ModeCharDevice != 0 && stat != nil && stat.Rdev == 0 {
+			return writeEmptyFile(tw, filepath.Join(filepath.Dir(name), whiteoutPrefix+info.Name()), info.ModTime())
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filePath); err != nil {
+				return errors.Wrapf(err, "readlink %s", filePath)
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "tar header of %s", filePath)
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// 容器内的用户在宿主机上没有意义，只保留 uid、gid
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Format = tar.FormatPAX
+		if hdr.PAXRecords, err = readXattrs(filePath); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && stat != nil && stat.Nlink > 1 {
+			if target, exist := hardlinks[stat.Ino]; exist {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, target, 0
+			} else {
+				hardlinks[stat.Ino] = name
+			}
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write tar header of %s", filePath)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err = copyFile(tw, filePath); err != nil {
+				return err
+			}
+		}
+		if otherFS {
+			return filepath.SkipDir
+		}
+		if whiteout && info.IsDir() && isOpaqueDir(filePath) {
+			return writeEmptyFile(tw, filepath.Join(name, whiteoutOpaqueDir), info.ModTime())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ApplyLayer 将层解压到 dir，层可以是 tar 或者 tar+gzip 格式
+/*
+OCI 的 whiteout 文件会被转换回 overlayfs 的格式，这样 dir 直接作为 lowerdir 时就能遮住下层的文件。
+层中的路径不能通过 .. 或者已有的符号链接指向 dir 之外。
+*/
+func ApplyLayer(r io.Reader, dir string) error {
+	reader, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %s", dir)
+	}
+
+	tr := tar.NewReader(reader)
+	// 目录的修改时间在目录下的文件都解压完后再设置
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read layer")
+		}
+		target, err := safeJoin(realDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == realDir {
+			continue
+		}
+		parent, base := filepath.Dir(target), filepath.Base(target)
+		if err = os.MkdirAll(parent, constant.Perm0755); err != nil {
+			return errors.Wrapf(err, "mkdir %s", parent)
+		}
+		switch {
+		case base == whiteoutOpaqueDir:
+			if err = unix.Lsetxattr(parent, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+				return errors.Wrapf(err, "set opaque xattr on %s", parent)
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if err = createWhiteout(realDir, hdr.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = createEntry(realDir, target, hdr, tr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+	for _, hdr := range dirs {
+		target, _ := safeJoin(realDir, hdr.Name)
+		if err = os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return errors.Wrapf(err, "chtimes %s", target)
+		}
+	}
+	return nil
+}
+
+// decompress 根据文件头判断内容是否经过 gzip 压缩，返回解压后的内容
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "open gzip")
+		}
+		return gz, nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// createEntry 根据 tar 头创建文件，同名的文件已经存在时先删除，目录除外
+func createEntry(dir, target string, hdr *tar.Header, r io.Reader) error {
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err = os.RemoveAll(target); err != nil {
+			return errors.Wrapf(err, "remove %s", target)
+		}
+	}
+	mode := uint32(hdr.Mode) & 07777
+	var err error
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err = os.Mkdir(target, os.FileMode(mode)); os.IsExist(err) {
+			err = nil
+		}
+	case tar.TypeReg:
+		err = writeFile(target, os.FileMode(mode), r)
+	case tar.TypeSymlink:
+		err = os.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		var linkTarget string
+		if linkTarget, err = safeJoin(dir, hdr.Linkname); err == nil {
+			err = os.Link(linkTarget, target)
+		}
+	case tar.TypeChar:
+		err = unix.Mknod(target, unix.S_IFCHR|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	case tar.TypeBlock:
+		err = unix.Mknod(target, unix.S_IFBLK|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	case tar.TypeFifo:
+		err = unix.Mkfifo(target, mode)
+	default:
+		log.Warnf("skip unsupported tar entry %s type %c", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "create %s", target)
+	}
+
+	for key, value := range hdr.PAXRecords {
+		// overlayfs 的扩展属性会改变 lowerdir 的行为，不能由层设置
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if attr == key || strings.HasPrefix(attr, overlayXattrPrefix) {
+			continue
+		}
+		if err = unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			return errors.Wrapf(err, "set xattr %s on %s", key, target)
+		}
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		return nil
+	}
+	if err = os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return errors.Wrapf(err, "chown %s", target)
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// chown 会清除 setuid 位，所以最后再设置权限
+	if err = os.Chmod(target, hdr.FileInfo().Mode()); err != nil {
+		return errors.Wrapf(err, "chmod %s", target)
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if err = os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return errors.Wrapf(err, "chtimes %s", target)
+		}
+	}
+	return nil
+}
+
+// createWhiteout 将层中的 .wh.<name> 转换为 overlayfs 的 whiteout，即设备号为 0:0 的字符设备
+func createWhiteout(dir, entry string) error {
+	name := strings.TrimPrefix(path.Base(entry), whiteoutPrefix)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid whiteout entry %s", entry)
+	}
+	target, err := safeJoin(dir, path.Join(path.Dir(entry), name))
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(target); err != nil {
+		return errors.Wrapf(err, "remove %s", target)
+	}
+	if err = unix.Mknod(target, unix.S_IFCHR, 0); err != nil {
+		return errors.Wrapf(err, "create whiteout %s", target)
+	}
+	return nil
+}
+
+// safeJoin 返回 name 在 dir 下的路径，路径中已经存在的部分不能通过符号链接指向 dir 之外
+func safeJoin(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.Clean("/"+name))
+	if target == dir {
+		return target, nil
+	}
+	existing := filepath.Dir(target)
+	for existing != dir {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve %s", existing)
+	}
+	if real != dir && !strings.HasPrefix(real, dir+"/") {
+		return "", fmt.Errorf("layer entry %s breaks out of %s", name, dir)
+	}
+	return target, nil
+}
+
+// readXattrs 读取文件的扩展属性并转换为 PAX 记录，overlayfs 自己使用的 trusted.overlay.* 除外
+func readXattrs(filePath string) (map[string]string, error) {
+	size, err := unix.Llistxattr(filePath, nil)
+	if err != nil || size == 0 {
+		// 文件系统不支持扩展属性时忽略
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(filePath, buf); err != nil {
+		return nil, errors.Wrapf(err, "list xattrs of %s", filePath)
+	}
+	var records map[string]string
+	for _, key := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if key == "" || strings.HasPrefix(key, overlayXattrPrefix) {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(filePath, key, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(filePath, key, value); err != nil {
+			continue
+		}
+		if records == nil {
+			records = make(map[string]string)
+		}
+		records[paxXattrPrefix+key] = string(value[:valueSize])
+	}
+	return records, nil
+}
+
+func isOpaqueDir(dir string) bool {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+func writeEmptyFile(tw *tar.Writer, name string, modTime time.Time) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "write tar header of %s", name)
+	}
+	return nil
+}
+
+func writeFile(target string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func copyFile(w io.Writer, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", filePath)
+	}
+	defer f.Close()
+	if _, err = io.Copy(w, f); err != nil {
+		return errors.Wrapf(err, "copy %s", filePath)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestWriteAndApplyLayer(t *testing.T) {
+	upper := t.TempDir()
+	if err := os.WriteFile(path.Join(upper, "file"), []byte("content"), 0644); err != nil {
+		t.Fatalf("write file %v", err)
+	}
+	if err := os.Link(path.Join(upper, "file"), path.Join(upper, "hardlink")); err != nil {
+		t.Fatalf("link %v", err)
+	}
+	if err := os.Symlink("file", path.Join(upper, "symlink")); err != nil {
+		t.Fatalf("symlink %v", err)
+	}
+	if err := os.Mkdir(path.Join(upper, "opaque"), 0755); err != nil {
+		t.Fatalf("mkdir %v", err)
+	}
+	// overlayfs 的 whiteout 和 opaque 目录需要 root 权限
+	if err := unix.Mknod(path.Join(upper, "deleted"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("create whiteout %v", err)
+	}
+	if err := unix.Lsetxattr(path.Join(upper, "opaque"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("set opaque xattr %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteLayer(&buf, upper); err != nil {
+		t.Fatalf("write layer %v", err)
+	}
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read layer %v", err)
+		}
+		entries[hdr.Name] = hdr
+	}
+	for _, name := range []string{"file", "hardlink", "symlink", "opaque/", ".wh.deleted", "opaque/.wh..wh..opq"} {
+		if entries[name] == nil {
+			t.Fatalf("entry %s not found in %v", name, entries)
+		}
+	}
+	if entries["deleted"] != nil {
+		t.Fatalf("whiteout device should not be kept")
+	}
+	if entries["hardlink"].Typeflag != tar.TypeLink && entries["file"].Typeflag != tar.TypeLink {
+		t.Fatalf("hardlink should be stored as link")
+	}
+
+	dir := t.TempDir()
+	if err := ApplyLayer(bytes.NewReader(buf.Bytes()), dir); err != nil {
+		t.Fatalf("apply layer %v", err)
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(path.Join(dir, "deleted"), &stat); err != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFCHR || stat.Rdev != 0 {
+		t.Fatalf("whiteout should be converted back to char device 0:0, %+v %v", stat, err)
+	}
+	if !isOpaqueDir(path.Join(dir, "opaque")) {
+		t.Fatalf("opaque dir should have opaque xattr")
+	}
+	if _, err := os.Stat(path.Join(dir, "opaque", whiteoutOpaqueDir)); !os.IsNotExist(err) {
+		t.Fatalf("opaque marker should not be extracted")
+	}
+	if content, err := os.ReadFile(path.Join(dir, "symlink")); err != nil || string(content) != "content" {
+		t.Fatalf("symlink not restored, %s %v", content, err)
+	}
+	file, _ := os.Stat(path.Join(dir, "file"))
+	link, _ := os.Stat(path.Join(dir, "hardlink"))
+	if !os.SameFile(file, link) {
+		t.Fatalf("hardlink not restored")
+	}
+}
+
+func TestApplyLayerStaysInDir(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0644})
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "root", Linkname: "/", Mode: 0777})
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "root/tmp/escape", Mode: 0644})
+	_ = tw.Close()
+
+	parent := t.TempDir()
+	dir := path.Join(parent, "layer")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("mkdir %v", err)
+	}
+	if err := ApplyLayer(&buf, dir); err == nil {
+		t.Fatalf("entry through symlink to / should be rejected")
+	}
+	if _, err := os.Stat(path.Join(parent, "escape")); !os.IsNotExist(err) {
+		t.Fatalf("../escape should not be written outside layer dir")
+	}
+	if _, err := os.Stat(path.Join(dir, "escape")); err != nil {
+		t.Fatalf("../escape should be written inside layer dir %v", err)
+	}
+}
+
+func TestApplyLayerRejectsInvalidWhiteout(t *testing.T) {
+	for _, name := range []string{".wh...", ".wh..", ".wh.", "sub/.wh..."} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644})
+		_ = tw.Close()
+
+		parent := t.TempDir()
+		dir := path.Join(parent, "layer")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("mkdir %v", err)
+		}
+		if err := ApplyLayer(&buf, dir); err == nil {
+			t.Fatalf("whiteout %s should be rejected", name)
+		}
+		for _, dirPath := range []string{parent, dir} {
+			if stat, err := os.Lstat(dirPath); err != nil || !stat.IsDir() {
+				t.Fatalf("whiteout %s should not replace %s, %v", name, dirPath, err)
+			}
+		}
+	}
+}
+
+func TestApplyLayerDropsOverlayXattrs(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeDir,
+		Name:       "dir/",
+		Mode:       0755,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{paxXattrPrefix + overlayOpaqueXattr: "y"},
+	})
+	_ = tw.Close()
+
+	dir := t.TempDir()
+	if err := ApplyLayer(&buf, dir); err != nil {
+		t.Fatalf("apply layer %v", err)
+	}
+	if isOpaqueDir(path.Join(dir, "dir")) {
+		t.Fatalf("overlay xattrs from layer should be dropped")
+	}
+}
+
+func TestWriteLayerExcludes(t *testing.T) {
+	upper := t.TempDir()
+	for _, name := range []string{"etc/hosts", "etc/passwd"} {
+		if err := os.MkdirAll(path.Dir(path.Join(upper, name)), 0755); err != nil {
+			t.Fatalf("mkdir %v", err)
+		}
+		if err := os.WriteFile(path.Join(upper, name), nil, 0644); err != nil {
+			t.Fatalf("write %s %v", name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteLayer(&buf, upper, "etc/hosts", "etc/resolv.conf"); err != nil {
+		t.Fatalf("write layer %v", err)
+	}
+	names := make(map[string]bool)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read layer %v", err)
+		}
+		names[hdr.Name] = true
+	}
+	if names["etc/hosts"] || !names["etc/passwd"] {
+		t.Fatalf("only etc/hosts should be excluded, got %v", names)
+	}
+}
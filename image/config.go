@@ -0,0 +1,141 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeConfig = "application/vnd.oci.image.config.v1+json"
+	// 层的 diff id 类型，diff id 为未压缩的层的摘要
+	rootfsTypeLayers = "layers"
+)
+
+// ImageConfig 镜像配置，参考 OCI 镜像规范中的 config，以 blob 的形式保存，由镜像清单引用
+type ImageConfig struct {
+	Created      time.Time       `json:"created"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+}
+
+// ContainerConfig 使用镜像创建容器时的默认配置
+type ContainerConfig struct {
+	Env          []string            `json:"Env,omitempty"`          // 环境变量，格式为 key=value
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`   // 容器命令的前缀
+	Cmd          []string            `json:"Cmd,omitempty"`          // run 没有指定命令时使用的命令
+	WorkingDir   string              `json:"WorkingDir,omitempty"`   // 容器进程的工作目录
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"` // 容器监听的端口，格式为 port/proto
+}
+
+// RootFS 按从最底层到最上层的顺序列出每一层未压缩时的摘要
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// Command 返回容器要运行的命令，即 Entrypoint 加上 args，args 为空时使用 Cmd
+func (c *ContainerConfig) Command(args []string) []string {
+	if len(args) == 0 {
+		args = c.Cmd
+	}
+	command := make([]string, 0, len(c.Entrypoint)+len(args))
+	command = append(command, c.Entrypoint...)
+	return append(command, args...)
+}
+
+// ApplyChange 将 Dockerfile 风格的指令应用到配置上，commit --change 使用
+/*
+支持的指令:
+- CMD、ENTRYPOINT: 值为 JSON 数组时直接使用，否则按空白分割，不经过 shell
+- ENV key=value ...，或者 ENV key value
+- WORKDIR /path
+- EXPOSE port[/proto] ...，未指定协议时为 tcp
+*/
+func (c *ContainerConfig) ApplyChange(change string) error {
+	change = strings.TrimSpace(change)
+	instruction, value := change, ""
+	if idx := strings.IndexAny(change, " \t"); idx > 0 {
+		instruction, value = change[:idx], strings.TrimSpace(change[idx+1:])
+	}
+	if value == "" {
+		return fmt.Errorf("change %q missing value", change)
+	}
+	switch strings.ToUpper(instruction) {
+	case "CMD":
+		args, err := parseCommand(value)
+		if err != nil {
+			return err
+		}
+		c.Cmd = args
+	case "ENTRYPOINT":
+		args, err := parseCommand(value)
+		if err != nil {
+			return err
+		}
+		c.Entrypoint = args
+	case "ENV":
+		var envs []string
+		if fields := strings.Fields(value); !strings.Contains(fields[0], "=") {
+			// ENV key value 格式，key 之后的内容都是值
+			envs = []string{fields[0] + "=" + strings.TrimSpace(strings.TrimPrefix(value, fields[0]))}
+		} else {
+			envs = fields
+		}
+		for _, env := range envs {
+			if !strings.Contains(env, "=") || strings.HasPrefix(env, "=") {
+				return fmt.Errorf("invalid env %q in change %q", env, change)
+			}
+		}
+		c.Env = MergeEnv(c.Env, envs)
+	case "WORKDIR":
+		if !path.IsAbs(value) {
+			return fmt.Errorf("workdir %s must be an absolute path", value)
+		}
+		c.WorkingDir = path.Clean(value)
+	case "EXPOSE":
+		for _, port := range strings.Fields(value) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			if c.ExposedPorts == nil {
+				c.ExposedPorts = make(map[string]struct{})
+			}
+			c.ExposedPorts[port] = struct{}{}
+		}
+	default:
+		return fmt.Errorf("unsupported change instruction %s", instruction)
+	}
+	return nil
+}
+
+// MergeEnv 合并环境变量，override 中的同名变量覆盖 base 中的值，保持变量第一次出现的顺序
+func MergeEnv(base, override []string) []string {
+	merged := make([]string, 0, len(base)+len(override))
+	index := make(map[string]int)
+	for _, env := range append(append([]string{}, base...), override...) {
+		key := strings.SplitN(env, "=", 2)[0]
+		if i, exist := index[key]; exist {
+			merged[i] = env
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, env)
+	}
+	return merged
+}
+
+func parseCommand(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		return strings.Fields(value), nil
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(value), &args); err != nil {
+		return nil, fmt.Errorf("invalid json array %s", value)
+	}
+	return args, nil
+}
@@ -0,0 +1,52 @@
+package image
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyChange(t *testing.T) {
+	config := &ContainerConfig{Env: []string{"PATH=/bin", "A=0"}}
+	changes := []string{
+		`CMD ["sh", "-c", "echo hello"]`,
+		"ENTRYPOINT /entrypoint.sh --debug",
+		"ENV A=1 B=2",
+		"ENV GREETING hello world",
+		"WORKDIR /app/",
+		"EXPOSE 80 53/udp",
+	}
+	for _, change := range changes {
+		if err := config.ApplyChange(change); err != nil {
+			t.Fatalf("apply %s %v", change, err)
+		}
+	}
+	expect := &ContainerConfig{
+		Env:          []string{"PATH=/bin", "A=1", "B=2", "GREETING=hello world"},
+		Entrypoint:   []string{"/entrypoint.sh", "--debug"},
+		Cmd:          []string{"sh", "-c", "echo hello"},
+		WorkingDir:   "/app",
+		ExposedPorts: map[string]struct{}{"80/tcp": {}, "53/udp": {}},
+	}
+	if !reflect.DeepEqual(config, expect) {
+		t.Fatalf("expect %+v got %+v", expect, config)
+	}
+	if command := config.Command(nil); !reflect.DeepEqual(command, []string{"/entrypoint.sh", "--debug", "sh", "-c", "echo hello"}) {
+		t.Fatalf("unexpected command %v", command)
+	}
+	if command := config.Command([]string{"top"}); !reflect.DeepEqual(command, []string{"/entrypoint.sh", "--debug", "top"}) {
+		t.Fatalf("args should replace cmd, got %v", command)
+	}
+
+	for _, change := range []string{"CMD", "USER root", "WORKDIR app", "ENV =1", `CMD ["sh"`} {
+		if err := config.ApplyChange(change); err == nil {
+			t.Fatalf("apply %s should fail", change)
+		}
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	merged := MergeEnv([]string{"PATH=/bin", "A=1"}, []string{"B=2", "PATH=/usr/bin"})
+	if !reflect.DeepEqual(merged, []string{"PATH=/usr/bin", "A=1", "B=2"}) {
+		t.Fatalf("unexpected env %v", merged)
+	}
+}
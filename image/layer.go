@@ -0,0 +1,171 @@
+package image
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"mydocker/constant"
+	"mydocker/utils"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// 层的引用信息，层摘要到引用者列表的映射
+	layerRefsFile = "refs.json"
+	// 引用者的前缀，引用者格式为 image:<id> 或者 container:<id>
+	imageHolderPrefix     = "image:"
+	containerHolderPrefix = "container:"
+)
+
+// LayerStore 解压后的只读镜像层
+/*
+每个层只解压一次，放在 Root/<hex> 目录下，所有使用该层的容器都直接将其作为 overlayfs 的 lowerdir。
+层被镜像和容器引用，只有在没有任何镜像和容器引用时才会被删除。
+*/
+type LayerStore struct {
+	Root string
+	Refs map[string][]string
+}
+
+// DefaultLayerStore 默认使用 /var/lib/mydocker/overlay2/layers/ 存放解压后的层
+var DefaultLayerStore = &LayerStore{Root: utils.LayerPath}
+
+// ImageHolder 镜像作为层的引用者
+func ImageHolder(imageID string) string {
+	return imageHolderPrefix + imageID
+}
+
+// ContainerHolder 容器作为层的引用者
+func ContainerHolder(containerID string) string {
+	return containerHolderPrefix + containerID
+}
+
+// Acquire 获取层的目录，层还没有解压时将 blobPath 解压，并为层添加引用者
+func (ls *LayerStore) Acquire(digest, blobPath string, holders ...string) (layerDir string, err error) {
+	err = ls.withLock(func() error {
+		layerDir = ls.Path(digest)
+		exist, err := utils.PathExists(layerDir)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			if err = extractLayer(blobPath, layerDir); err != nil {
+				return err
+			}
+		}
+		for _, holder := range holders {
+			if !containsString(ls.Refs[digest], holder) {
+				ls.Refs[digest] = append(ls.Refs[digest], holder)
+			}
+		}
+		return nil
+	})
+	return layerDir, err
+}
+
+// Release 删除 holder 对所有层的引用，删除不再被引用的层
+func (ls *LayerStore) Release(holder string) error {
+	return ls.withLock(func() error {
+		for digest, holders := range ls.Refs {
+			remain := holders[:0]
+			for _, h := range holders {
+				if h != holder {
+					remain = append(remain, h)
+				}
+			}
+			if len(remain) > 0 {
+				ls.Refs[digest] = remain
+				continue
+			}
+			delete(ls.Refs, digest)
+			log.Infof("remove unused layer %s", digest)
+			if err := os.RemoveAll(ls.Path(digest)); err != nil {
+				return errors.Wrapf(err, "remove layer %s", digest)
+			}
+		}
+		return nil
+	})
+}
+
+// Path 层解压后的目录
+func (ls *LayerStore) Path(digest string) string {
+	return path.Join(ls.Root, strings.TrimPrefix(digest, digestPrefix))
+}
+
+// extractLayer 先解压到临时目录再 rename，避免解压到一半的层被使用
+func extractLayer(blobPath, layerDir string) error {
+	tmpDir := layerDir + ".tmp"
+	_ = os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, constant.Perm0755); err != nil {
+		return errors.Wrapf(err, "mkdir %s", tmpDir)
+	}
+	blob, err := os.Open(blobPath)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return errors.Wrapf(err, "open %s", blobPath)
+	}
+	defer blob.Close()
+	if err = ApplyLayer(blob, tmpDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return errors.WithMessagef(err, "extract %s", blobPath)
+	}
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		return errors.Wrapf(err, "rename %s", tmpDir)
+	}
+	return nil
+}
+
+func (ls *LayerStore) withLock(fn func() error) error {
+	if err := os.MkdirAll(ls.Root, constant.Perm0755); err != nil {
+		return errors.Wrapf(err, "mkdir %s", ls.Root)
+	}
+	lockFile, err := os.OpenFile(path.Join(ls.Root, ".lock"), os.O_CREATE|os.O_RDWR, constant.Perm0644)
+	if err != nil {
+		return errors.Wrap(err, "open layer store lock file")
+	}
+	defer lockFile.Close()
+	if err = unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return errors.Wrap(err, "lock layer store")
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	if err = ls.load(); err != nil {
+		return err
+	}
+	if err = fn(); err != nil {
+		return err
+	}
+	content, err := json.Marshal(ls.Refs)
+	if err != nil {
+		return errors.Wrap(err, "marshal layer refs")
+	}
+	return writeFileAtomic(path.Join(ls.Root, layerRefsFile), content)
+}
+
+func (ls *LayerStore) load() error {
+	ls.Refs = map[string][]string{}
+	refsPath := path.Join(ls.Root, layerRefsFile)
+	content, err := os.ReadFile(refsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "read %s", refsPath)
+	}
+	if err = json.Unmarshal(content, &ls.Refs); err != nil {
+		return errors.Wrapf(err, "unmarshal %s", refsPath)
+	}
+	return nil
+}
+
+func containsString(items []string, target string) bool {
+	for _, item := range items {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package image
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+// createTestLayer 将只包含一个文件的目录打包为层
+func createTestLayer(t *testing.T, fileName, content string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, fileName), []byte(content), 0644); err != nil {
+		t.Fatalf("write %s %v", fileName, err)
+	}
+	blob := path.Join(t.TempDir(), "layer.tar")
+	if out, err := exec.Command("tar", "-cf", blob, "-C", dir, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar layer %v %s", err, out)
+	}
+	return blob
+}
+
+func TestLayerStoreRefCount(t *testing.T) {
+	ls := &LayerStore{Root: t.TempDir()}
+	blob := createTestLayer(t, "hello", "world")
+	digest, err := fileDigest(blob)
+	if err != nil {
+		t.Fatalf("digest %v", err)
+	}
+
+	dir, err := ls.Acquire(digest, blob, ImageHolder("img"), ContainerHolder("c1"))
+	if err != nil {
+		t.Fatalf("acquire %v", err)
+	}
+	content, err := os.ReadFile(path.Join(dir, "hello"))
+	if err != nil || string(content) != "world" {
+		t.Fatalf("layer not extracted, %s %v", content, err)
+	}
+	// 已经解压的层不会重复解压
+	if err = os.WriteFile(path.Join(dir, "marker"), nil, 0644); err != nil {
+		t.Fatalf("write marker %v", err)
+	}
+	if _, err = ls.Acquire(digest, blob, ContainerHolder("c2")); err != nil {
+		t.Fatalf("acquire %v", err)
+	}
+	if _, err = os.Stat(path.Join(dir, "marker")); err != nil {
+		t.Fatalf("layer should be reused")
+	}
+
+	for _, holder := range []string{ImageHolder("img"), ContainerHolder("c1")} {
+		if err = ls.Release(holder); err != nil {
+			t.Fatalf("release %s %v", holder, err)
+		}
+		if _, err = os.Stat(dir); err != nil {
+			t.Fatalf("layer still used by c2 should be kept")
+		}
+	}
+	if err = ls.Release(ContainerHolder("c2")); err != nil {
+		t.Fatalf("release %v", err)
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("unused layer should be removed")
+	}
+}
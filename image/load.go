@@ -0,0 +1,396 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mydocker/constant"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// docker save 生成的归档中列出所有镜像的文件
+const dockerManifestFile = "manifest.json"
+
+// dockerManifest docker save 归档的 manifest.json 中的一项，路径都是相对于归档根目录的
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// archiveImage 归档中的一个镜像，digest 为空表示归档中没有记录摘要，不做校验
+type archiveImage struct {
+	refs         []string
+	config       string
+	configDigest string
+	layers       []string
+	layerDigests []string
+}
+
+// Load 导入 docker save 生成的归档或者 OCI 镜像布局，input 可以是 tar 文件(可以经过 gzip 压缩)或者解压后的目录
+/*
+- docker 归档: 根目录下有 manifest.json，镜像的引用来自其中的 RepoTags
+- OCI 镜像布局: 根目录下有 oci-layout 和 index.json，镜像的引用来自清单的 annotation，多平台镜像只导入当前平台
+导入前校验配置和层的 sha256 摘要，以及每一层解压后的摘要是否和配置中的 diff_ids 一致。
+归档中的镜像没有引用时使用 ref 作为引用，ref 为空时只能通过镜像 Id 使用。
+*/
+func (s *Store) Load(input, ref string) (loaded []*Summary, err error) {
+	if ref != "" {
+		if _, _, err = ParseReference(ref); err != nil {
+			return nil, err
+		}
+	}
+	stat, err := os.Stat(input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat %s", input)
+	}
+	dir := input
+	if !stat.IsDir() {
+		if err = os.MkdirAll(s.Root, constant.Perm0755); err != nil {
+			return nil, errors.Wrapf(err, "mkdir %s", s.Root)
+		}
+		if dir, err = os.MkdirTemp(s.Root, "load-"); err != nil {
+			return nil, errors.Wrap(err, "create temp dir")
+		}
+		defer os.RemoveAll(dir)
+		if err = extractArchive(input, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	images, err := readArchive(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ai := range images {
+		if len(ai.refs) == 0 && ref != "" {
+			ai.refs = []string{ref}
+		}
+		img, refs, err := s.importArchiveImage(dir, ai)
+		if err != nil {
+			return loaded, err
+		}
+		if len(refs) == 0 {
+			loaded = append(loaded, &Summary{Image: img})
+		}
+		for _, r := range refs {
+			name, tag, _ := ParseReference(r)
+			loaded = append(loaded, &Summary{Name: name, Tag: tag, Image: img})
+		}
+	}
+	return loaded, nil
+}
+
+// importArchiveImage 校验并导入归档中的一个镜像，返回镜像和成功添加的引用
+func (s *Store) importArchiveImage(dir string, ai *archiveImage) (img *Image, refs []string, err error) {
+	configContent, err := readVerified(dir, ai.config, ai.configDigest)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &ImageConfig{}
+	if err = json.Unmarshal(configContent, config); err != nil {
+		return nil, nil, errors.Wrapf(err, "unmarshal config %s", ai.config)
+	}
+	if len(config.RootFS.DiffIDs) != len(ai.layers) {
+		return nil, nil, fmt.Errorf("config %s has %d diff ids but image has %d layers",
+			ai.config, len(config.RootFS.DiffIDs), len(ai.layers))
+	}
+
+	// 所有层都校验通过后再导入镜像存储，避免留下导入一半的镜像
+	staged := make([]string, 0, len(ai.layers))
+	defer func() {
+		for _, tmp := range staged {
+			_ = os.Remove(tmp)
+		}
+	}()
+	for i, layer := range ai.layers {
+		tmp, err := s.stageBlob(dir, layer, ai.layerDigests[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		staged = append(staged, tmp)
+		diffID, err := layerDiffID(tmp)
+		if err != nil {
+			return nil, nil, err
+		}
+		if diffID != config.RootFS.DiffIDs[i] {
+			return nil, nil, fmt.Errorf("layer %s has diff id %s, expect %s", layer, diffID, config.RootFS.DiffIDs[i])
+		}
+	}
+
+	created := config.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	err = s.withLock(func() error {
+		layers := make([]Descriptor, 0, len(staged))
+		for _, tmp := range staged {
+			layer, _, err := s.addLayer(tmp)
+			if err != nil {
+				return err
+			}
+			layers = append(layers, layer)
+		}
+		if img, err = s.createImage(layers, configContent, created, ""); err != nil {
+			return err
+		}
+		for _, r := range ai.refs {
+			name, tag, err := ParseReference(normalizeArchiveRef(r))
+			if err != nil {
+				log.Warnf("skip reference %s of image %s: %v", r, ShortID(img.ID), err)
+				continue
+			}
+			s.Repositories[name+":"+tag] = img.ID
+			refs = append(refs, name+":"+tag)
+		}
+		return nil
+	})
+	return img, refs, err
+}
+
+// stageBlob 将归档中的文件复制到镜像目录下的临时文件，同时校验摘要
+func (s *Store) stageBlob(dir, name, digest string) (string, error) {
+	src, err := openInDir(dir, name)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmpFile, err := os.CreateTemp(s.Root, "layer-*.tmp")
+	if err != nil {
+		return "", errors.Wrap(err, "create temp layer file")
+	}
+	defer tmpFile.Close()
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmpFile, h), src); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return "", errors.Wrapf(err, "copy %s", name)
+	}
+	if actual := digestPrefix + hex.EncodeToString(h.Sum(nil)); digest != "" && actual != digest {
+		_ = os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("%s has digest %s, expect %s", name, actual, digest)
+	}
+	return tmpFile.Name(), nil
+}
+
+// readArchive 根据根目录下的文件判断归档格式，返回归档中的所有镜像
+func readArchive(dir string) ([]*archiveImage, error) {
+	if _, err := os.Stat(filepath.Join(dir, dockerManifestFile)); err == nil {
+		return readDockerArchive(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ociLayoutFile)); err == nil {
+		return readOCILayout(dir)
+	}
+	return nil, fmt.Errorf("%s is neither a docker archive nor an oci image layout", dir)
+}
+
+func readDockerArchive(dir string) ([]*archiveImage, error) {
+	var manifests []dockerManifest
+	if err := readJSON(dir, dockerManifestFile, "", &manifests); err != nil {
+		return nil, err
+	}
+	images := make([]*archiveImage, 0, len(manifests))
+	for _, m := range manifests {
+		ai := &archiveImage{
+			refs:         m.RepoTags,
+			config:       m.Config,
+			configDigest: dockerArchiveDigest(m.Config),
+			layers:       m.Layers,
+		}
+		for _, layer := range m.Layers {
+			ai.layerDigests = append(ai.layerDigests, dockerArchiveDigest(layer))
+		}
+		images = append(images, ai)
+	}
+	return images, nil
+}
+
+// dockerArchiveDigest 从文件名中获取摘要
+// 新版本 docker 的归档中文件为 blobs/sha256/<hex>，旧版本的配置为 <hex>.json，旧版本的层没有摘要
+func dockerArchiveDigest(name string) string {
+	digest := digestPrefix + strings.TrimSuffix(path.Base(name), ".json")
+	if !digestRegexp.MatchString(digest) {
+		return ""
+	}
+	return digest
+}
+
+func readOCILayout(dir string) ([]*archiveImage, error) {
+	layout := &ociLayout{}
+	if err := readJSON(dir, ociLayoutFile, "", layout); err != nil {
+		return nil, err
+	}
+	if layout.ImageLayoutVersion != ociLayoutVer {
+		return nil, fmt.Errorf("unsupported oci image layout version %s", layout.ImageLayoutVersion)
+	}
+	index := &ociIndex{}
+	if err := readJSON(dir, ociIndexFile, "", index); err != nil {
+		return nil, err
+	}
+	var images []*archiveImage
+	for _, desc := range index.Manifests {
+		ai, err := readOCIManifest(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+		if name := desc.Annotations[annotationContainerdName]; name != "" {
+			ai.refs = []string{name}
+		} else if name = desc.Annotations[annotationRefName]; strings.ContainsAny(name, ":/") {
+			// 只有 tag 的 ref.name 无法确定镜像名，忽略
+			ai.refs = []string{name}
+		}
+		images = append(images, ai)
+	}
+	return images, nil
+}
+
+// readOCIManifest 读取 desc 指向的镜像清单，desc 指向多平台清单列表时选择当前平台的清单
+func readOCIManifest(dir string, desc ociDescriptor) (*archiveImage, error) {
+	blobPath, err := ociBlobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if desc.MediaType == MediaTypeIndex || desc.MediaType == mediaTypeDockerManifestList {
+		index := &ociIndex{}
+		if err = readJSON(dir, blobPath, desc.Digest, index); err != nil {
+			return nil, err
+		}
+		for _, m := range index.Manifests {
+			if m.Platform == nil || (m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH) {
+				return readOCIManifest(dir, m)
+			}
+		}
+		return nil, fmt.Errorf("image index %s has no manifest for linux/%s", desc.Digest, runtime.GOARCH)
+	}
+
+	manifest := &Manifest{}
+	if err = readJSON(dir, blobPath, desc.Digest, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Config == nil {
+		return nil, fmt.Errorf("manifest %s has no config", desc.Digest)
+	}
+	ai := &archiveImage{configDigest: manifest.Config.Digest}
+	if ai.config, err = ociBlobPath(manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	for _, layer := range manifest.Layers {
+		layerPath, err := ociBlobPath(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		ai.layers = append(ai.layers, layerPath)
+		ai.layerDigests = append(ai.layerDigests, layer.Digest)
+	}
+	return ai, nil
+}
+
+// readJSON 读取并解析 dir 下的 json 文件，digest 不为空时校验内容的摘要
+func readJSON(dir, name, digest string, v interface{}) error {
+	content, err := readVerified(dir, name, digest)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		return errors.Wrapf(err, "unmarshal %s", name)
+	}
+	return nil
+}
+
+func readVerified(dir, name, digest string) ([]byte, error) {
+	f, err := openInDir(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", name)
+	}
+	if actual := bytesDigest(content); digest != "" && actual != digest {
+		return nil, fmt.Errorf("%s has digest %s, expect %s", name, actual, digest)
+	}
+	return content, nil
+}
+
+// extractArchive 解压镜像归档
+/*
+归档不是镜像层，只解压目录、普通文件和符号链接，不处理 whiteout、扩展属性和属主，
+文件的路径不能通过 .. 或者已有的符号链接指向 dir 之外。读取归档中的文件时通过 openInDir 校验符号链接。
+*/
+func extractArchive(input, dir string) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", input)
+	}
+	defer f.Close()
+	reader, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %s", dir)
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "read %s", input)
+		}
+		target, err := safeJoin(realDir, hdr.Name)
+		if err != nil {
+			return errors.WithMessagef(err, "extract %s", input)
+		}
+		if target == realDir {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(target), constant.Perm0755); err != nil {
+			return errors.Wrapf(err, "mkdir %s", filepath.Dir(target))
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.Mkdir(target, constant.Perm0755); os.IsExist(err) {
+				err = nil
+			}
+		case tar.TypeReg:
+			// 同名的文件可能是指向 dir 之外的符号链接，先删除
+			if err = os.RemoveAll(target); err == nil {
+				err = writeFile(target, constant.Perm0644, tr)
+			}
+		case tar.TypeSymlink:
+			if err = os.RemoveAll(target); err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		default:
+			log.Warnf("skip unsupported archive entry %s type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "extract %s", hdr.Name)
+		}
+	}
+}
+
+// normalizeArchiveRef 去掉 Docker Hub 镜像引用中的默认仓库前缀，例如 docker.io/library/busybox:latest
+func normalizeArchiveRef(ref string) string {
+	for _, prefix := range []string{"docker.io/library/", "docker.io/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
+}
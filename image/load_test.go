@@ -0,0 +1,211 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// tarBytes 生成只包含普通文件的 tar
+func tarBytes(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("write %s %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar %v", err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(content); err != nil {
+		t.Fatalf("gzip %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gzip %v", err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeTestFile(t *testing.T, filePath string, content []byte) {
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		t.Fatalf("mkdir %v", err)
+	}
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatalf("write %s %v", filePath, err)
+	}
+}
+
+func marshalTestJSON(t *testing.T, v interface{}) []byte {
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal %v", err)
+	}
+	return content
+}
+
+// testLayers 两层的镜像，上层删除了下层的 base 文件
+func testLayers(t *testing.T) ([][]byte, []byte) {
+	layers := [][]byte{
+		tarBytes(t, map[string]string{"base": "base", "keep": "keep"}),
+		tarBytes(t, map[string]string{".wh.base": "", "app": "app"}),
+	}
+	config := &ImageConfig{
+		Architecture: "amd64",
+		OS:           "linux",
+		Config:       ContainerConfig{Cmd: []string{"/app"}},
+		RootFS:       RootFS{Type: rootfsTypeLayers},
+	}
+	for _, layer := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digestPrefix+sha256Hex(layer))
+	}
+	return layers, marshalTestJSON(t, config)
+}
+
+// writeTestDockerArchive 将 testLayers 的镜像写入 dir，返回打包后的归档
+func writeTestDockerArchive(t *testing.T, dir string) string {
+	layers, config := testLayers(t)
+	configName := sha256Hex(config) + ".json"
+	writeTestFile(t, path.Join(dir, configName), config)
+	manifest := []dockerManifest{{Config: configName, RepoTags: []string{"docker.io/library/demo:v1"}}}
+	for i, layer := range layers {
+		layerName := path.Join(string(rune('a'+i)), "layer.tar")
+		writeTestFile(t, path.Join(dir, layerName), layer)
+		manifest[0].Layers = append(manifest[0].Layers, layerName)
+	}
+	writeTestFile(t, path.Join(dir, dockerManifestFile), marshalTestJSON(t, manifest))
+	archive := path.Join(t.TempDir(), "demo.tar")
+	if out, err := exec.Command("tar", "-cf", archive, "-C", dir, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar archive %v %s", err, out)
+	}
+	return archive
+}
+
+func TestLoadDockerArchive(t *testing.T) {
+	archive := writeTestDockerArchive(t, t.TempDir())
+
+	s := newTestStore(t)
+	s.Layers = &LayerStore{Root: t.TempDir()}
+	loaded, err := s.Load(archive, "")
+	if err != nil {
+		t.Fatalf("load %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Name != "demo" || loaded[0].Tag != "v1" {
+		t.Fatalf("unexpected loaded images %v", loaded)
+	}
+	img, err := s.Get("demo:v1")
+	if err != nil {
+		t.Fatalf("get demo:v1 %v", err)
+	}
+	if imgConfig, err := s.Config(img); err != nil || imgConfig.Config.Cmd[0] != "/app" {
+		t.Fatalf("config not loaded %+v %v", imgConfig, err)
+	}
+
+	dirs, err := s.LayerDirs(img, "c1")
+	if err != nil || len(dirs) != 2 {
+		t.Fatalf("layer dirs %v %v", dirs, err)
+	}
+	var stat syscall.Stat_t
+	if err = syscall.Lstat(path.Join(dirs[0], "base"), &stat); err != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		t.Fatalf("whiteout of base should be applied in top layer, %v", err)
+	}
+}
+
+func TestLoadOCILayout(t *testing.T) {
+	layers, config := testLayers(t)
+	dir := t.TempDir()
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        &Descriptor{MediaType: MediaTypeConfig, Digest: digestPrefix + sha256Hex(config), Size: int64(len(config))},
+	}
+	writeTestFile(t, path.Join(dir, "blobs/sha256", sha256Hex(config)), config)
+	for _, layer := range layers {
+		compressed := gzipBytes(t, layer)
+		writeTestFile(t, path.Join(dir, "blobs/sha256", sha256Hex(compressed)), compressed)
+		manifest.Layers = append(manifest.Layers, Descriptor{
+			MediaType: MediaTypeLayerGzip,
+			Digest:    digestPrefix + sha256Hex(compressed),
+			Size:      int64(len(compressed)),
+		})
+	}
+	manifestContent := marshalTestJSON(t, manifest)
+	writeTestFile(t, path.Join(dir, "blobs/sha256", sha256Hex(manifestContent)), manifestContent)
+	index := &ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{{
+		Descriptor: Descriptor{
+			MediaType: MediaTypeManifest,
+			Digest:    digestPrefix + sha256Hex(manifestContent),
+			Size:      int64(len(manifestContent)),
+		},
+		Annotations: map[string]string{annotationRefName: "latest"},
+	}}}
+	writeTestFile(t, path.Join(dir, ociIndexFile), marshalTestJSON(t, index))
+	writeTestFile(t, path.Join(dir, ociLayoutFile), marshalTestJSON(t, &ociLayout{ImageLayoutVersion: ociLayoutVer}))
+
+	// ref.name 只有 tag 时使用 -t 指定的引用
+	s := newTestStore(t)
+	loaded, err := s.Load(dir, "oci:v1")
+	if err != nil {
+		t.Fatalf("load %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Name != "oci" || len(loaded[0].Image.Manifest.Layers) != 2 {
+		t.Fatalf("unexpected loaded images %v", loaded)
+	}
+	if loaded[0].Image.Manifest.Layers[0].MediaType != MediaTypeLayerGzip {
+		t.Fatalf("gzip layer should be kept, got %+v", loaded[0].Image.Manifest.Layers[0])
+	}
+
+	// 层的内容和摘要不一致时拒绝导入
+	corrupted := path.Join(dir, "blobs/sha256", strings.TrimPrefix(manifest.Layers[1].Digest, digestPrefix))
+	writeTestFile(t, corrupted, gzipBytes(t, tarBytes(t, map[string]string{"evil": "evil"})))
+	s = newTestStore(t)
+	if _, err = s.Load(dir, "oci:v1"); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Fatalf("load corrupted layout should fail, got %v", err)
+	}
+	if summaries, _ := s.List(); len(summaries) != 0 {
+		t.Fatalf("corrupted image should not be registered, got %v", summaries)
+	}
+}
+
+func TestLoadArchiveIsNotALayer(t *testing.T) {
+	// 归档中的 whiteout 文件不能删除镜像存储
+	dir := t.TempDir()
+	writeTestFile(t, path.Join(dir, ".wh..."), nil)
+	writeTestFile(t, path.Join(dir, ".wh.manifest.json"), nil)
+	archive := writeTestDockerArchive(t, dir)
+
+	s := newTestStore(t)
+	if _, err := s.Load(archive, ""); err != nil {
+		t.Fatalf("load %v", err)
+	}
+	if stat, err := os.Lstat(s.Root); err != nil || !stat.IsDir() {
+		t.Fatalf("image store should not be replaced, %v", err)
+	}
+	if _, err := s.Get("demo:v1"); err != nil {
+		t.Fatalf("get demo:v1 %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package image
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// OCI 镜像布局中的文件
+	ociLayoutFile  = "oci-layout"
+	ociIndexFile   = "index.json"
+	ociBlobsDir    = "blobs"
+	ociLayoutVer   = "1.0.0"
+	MediaTypeIndex = "application/vnd.oci.image.index.v1+json"
+	// docker 格式的多平台清单列表，和 OCI index 结构相同
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// 镜像引用相关的 annotation，containerd 导出的镜像中 ref.name 只有 tag，完整引用在 image.name 中
+	annotationRefName        = "org.opencontainers.image.ref.name"
+	annotationContainerdName = "io.containerd.image.name"
+)
+
+var digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ociLayout oci-layout 文件的内容
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// ociIndex index.json 的内容，列出布局中的所有镜像清单，多平台镜像的清单列表也是这个格式
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociDescriptor index 中的描述，比层的描述多了 annotation 和平台信息
+type ociDescriptor struct {
+	Descriptor
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ociBlobPath 摘要对应的 OCI 布局中的 blob 路径，只支持 sha256
+func ociBlobPath(digest string) (string, error) {
+	if !digestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("unsupported digest %s", digest)
+	}
+	return filepath.Join(ociBlobsDir, "sha256", strings.TrimPrefix(digest, digestPrefix)), nil
+}
+
+// openInDir 打开 dir 下的文件，文件本身或者路径中的符号链接都不能指向 dir 之外
+func openInDir(dir, name string) (*os.File, error) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", dir)
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(realDir, filepath.Clean("/"+name)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", name)
+	}
+	if !strings.HasPrefix(target, realDir+"/") {
+		return nil, fmt.Errorf("%s points outside of %s", name, dir)
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", name)
+	}
+	return f, nil
+}
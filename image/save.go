@@ -0,0 +1,185 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Save 将镜像导出为 OCI 镜像布局格式的 tar，写入 w
+/*
+输出的 tar 包含:
+- oci-layout: 布局版本
+- blobs/sha256/<hex>: 镜像清单、配置以及 gzip 压缩的层，存储中没有压缩的层在导出时压缩
+- index.json: 列出每个镜像的清单，通过 name:tag 导出的镜像在 annotation 中记录引用
+多个镜像共享的 blob 只写入一次。
+*/
+func (s *Store) Save(w io.Writer, refs ...string) error {
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{ociBlobsDir + "/", ociBlobsDir + "/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: time.Now()}); err != nil {
+			return errors.Wrapf(err, "write %s", dir)
+		}
+	}
+	layout, err := json.Marshal(&ociLayout{ImageLayoutVersion: ociLayoutVer})
+	if err != nil {
+		return errors.Wrap(err, "marshal oci layout")
+	}
+	if err = writeTarFile(tw, ociLayoutFile, layout); err != nil {
+		return err
+	}
+
+	index := &ociIndex{SchemaVersion: 2, MediaType: MediaTypeIndex}
+	written := make(map[string]bool)
+	for _, ref := range refs {
+		img, err := s.Get(ref)
+		if err != nil {
+			return err
+		}
+		desc, err := s.saveImage(tw, img, written)
+		if err != nil {
+			return errors.WithMessagef(err, "save image %s", ref)
+		}
+		// 通过镜像 Id 导出时没有引用
+		if name, tag, err := ParseReference(ref); err == nil {
+			if imgRefs, _ := s.References(img.ID); containsString(imgRefs, name+":"+tag) {
+				desc.Annotations = map[string]string{
+					annotationRefName:        tag,
+					annotationContainerdName: name + ":" + tag,
+				}
+			}
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "marshal oci index")
+	}
+	if err = writeTarFile(tw, ociIndexFile, content); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// saveImage 写入镜像的配置、层和清单，返回清单的描述
+func (s *Store) saveImage(tw *tar.Writer, img *Image, written map[string]bool) (ociDescriptor, error) {
+	config, err := s.Config(img)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	// 直接使用原始的配置，保证摘要不变
+	configContent, err := os.ReadFile(s.BlobPath(img.Manifest.Config.Digest))
+	if err != nil {
+		return ociDescriptor{}, errors.Wrapf(err, "read config of image %s", img.ID)
+	}
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        &Descriptor{MediaType: MediaTypeConfig, Digest: bytesDigest(configContent), Size: int64(len(configContent))},
+	}
+	if err = writeBlob(tw, manifest.Config.Digest, configContent, written); err != nil {
+		return ociDescriptor{}, err
+	}
+	for _, layer := range img.Manifest.Layers {
+		if layer.MediaType != MediaTypeLayerGzip {
+			if layer, err = s.saveCompressedLayer(tw, layer, written); err != nil {
+				return ociDescriptor{}, err
+			}
+		} else if err = writeBlobFile(tw, layer.Digest, s.BlobPath(layer.Digest), written); err != nil {
+			return ociDescriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return ociDescriptor{}, errors.Wrap(err, "marshal manifest")
+	}
+	desc := ociDescriptor{
+		Descriptor: Descriptor{MediaType: MediaTypeManifest, Digest: bytesDigest(content), Size: int64(len(content))},
+		Platform:   &ociPlatform{Architecture: config.Architecture, OS: config.OS},
+	}
+	return desc, writeBlob(tw, desc.Digest, content, written)
+}
+
+// saveCompressedLayer 将没有压缩的层压缩到临时文件后写入，返回压缩后的层的描述
+func (s *Store) saveCompressedLayer(tw *tar.Writer, layer Descriptor, written map[string]bool) (Descriptor, error) {
+	src, err := os.Open(s.BlobPath(layer.Digest))
+	if err != nil {
+		return Descriptor{}, errors.Wrapf(err, "open layer %s", layer.Digest)
+	}
+	defer src.Close()
+	tmpFile, err := os.CreateTemp(s.Root, "save-*.tmp")
+	if err != nil {
+		return Descriptor{}, errors.Wrap(err, "create temp layer file")
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	h := sha256.New()
+	gw := gzip.NewWriter(io.MultiWriter(tmpFile, h))
+	if _, err = io.Copy(gw, src); err != nil {
+		return Descriptor{}, errors.Wrapf(err, "compress layer %s", layer.Digest)
+	}
+	if err = gw.Close(); err != nil {
+		return Descriptor{}, errors.Wrapf(err, "compress layer %s", layer.Digest)
+	}
+	stat, err := tmpFile.Stat()
+	if err != nil {
+		return Descriptor{}, errors.Wrapf(err, "stat %s", tmpFile.Name())
+	}
+	compressed := Descriptor{
+		MediaType: MediaTypeLayerGzip,
+		Digest:    digestPrefix + hex.EncodeToString(h.Sum(nil)),
+		Size:      stat.Size(),
+	}
+	return compressed, writeBlobFile(tw, compressed.Digest, tmpFile.Name(), written)
+}
+
+func writeBlob(tw *tar.Writer, digest string, content []byte, written map[string]bool) error {
+	if written[digest] {
+		return nil
+	}
+	name, err := ociBlobPath(digest)
+	if err != nil {
+		return err
+	}
+	written[digest] = true
+	return writeTarFile(tw, name, content)
+}
+
+func writeBlobFile(tw *tar.Writer, digest, filePath string, written map[string]bool) error {
+	if written[digest] {
+		return nil
+	}
+	name, err := ociBlobPath(digest)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", filePath)
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: stat.Size(), ModTime: stat.ModTime()}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "write %s", name)
+	}
+	written[digest] = true
+	return copyFile(tw, filePath)
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "write %s", name)
+	}
+	if _, err := tw.Write(content); err != nil {
+		return errors.Wrapf(err, "write %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// readTestTar 读取 tar 中的所有普通文件
+func readTestTar(t *testing.T, content []byte) map[string][]byte {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(content))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("read tar %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s %v", hdr.Name, err)
+		}
+		if _, exist := files[hdr.Name]; exist {
+			t.Fatalf("duplicate entry %s", hdr.Name)
+		}
+		files[hdr.Name] = data
+	}
+}
+
+// blobOf 返回 desc 指向的 blob，同时校验摘要和大小
+func blobOf(t *testing.T, files map[string][]byte, desc Descriptor) []byte {
+	content, exist := files[path.Join("blobs/sha256", strings.TrimPrefix(desc.Digest, digestPrefix))]
+	if !exist {
+		t.Fatalf("blob %s not found", desc.Digest)
+	}
+	if digestPrefix+sha256Hex(content) != desc.Digest || int64(len(content)) != desc.Size {
+		t.Fatalf("blob %s digest or size mismatch", desc.Digest)
+	}
+	return content
+}
+
+func TestSaveOCILayout(t *testing.T) {
+	s := newTestStore(t)
+	// base 的层没有压缩，导出时需要压缩
+	baseLayer := path.Join(t.TempDir(), "base.tar")
+	writeTestFile(t, baseLayer, tarBytes(t, map[string]string{"base": "base"}))
+	base, err := s.Create("base", nil, baseLayer, &ContainerConfig{Cmd: []string{"sh"}})
+	if err != nil {
+		t.Fatalf("create base %v", err)
+	}
+	appLayer := path.Join(t.TempDir(), "app.tar.gz")
+	writeTestFile(t, appLayer, gzipBytes(t, tarBytes(t, map[string]string{"app": "app"})))
+	if _, err = s.Create("app:v1", base, appLayer, nil); err != nil {
+		t.Fatalf("create app %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err = s.Save(&buf, "app:v1", "base"); err != nil {
+		t.Fatalf("save %v", err)
+	}
+	files := readTestTar(t, buf.Bytes())
+
+	layout := &ociLayout{}
+	if err = json.Unmarshal(files[ociLayoutFile], layout); err != nil || layout.ImageLayoutVersion != "1.0.0" {
+		t.Fatalf("invalid oci-layout %s %v", files[ociLayoutFile], err)
+	}
+	index := &ociIndex{}
+	if err = json.Unmarshal(files[ociIndexFile], index); err != nil {
+		t.Fatalf("invalid index.json %v", err)
+	}
+	if index.SchemaVersion != 2 || len(index.Manifests) != 2 {
+		t.Fatalf("unexpected index %s", files[ociIndexFile])
+	}
+	if index.Manifests[0].Annotations[annotationRefName] != "v1" || index.Manifests[1].Annotations[annotationRefName] != DefaultTag {
+		t.Fatalf("unexpected annotations %s", files[ociIndexFile])
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.MediaType != MediaTypeManifest {
+			t.Fatalf("unexpected manifest media type %s", desc.MediaType)
+		}
+		manifest := &Manifest{}
+		if err = json.Unmarshal(blobOf(t, files, desc.Descriptor), manifest); err != nil {
+			t.Fatalf("invalid manifest %v", err)
+		}
+		if manifest.SchemaVersion != 2 || manifest.MediaType != MediaTypeManifest || manifest.Config.MediaType != MediaTypeConfig {
+			t.Fatalf("unexpected manifest %+v", manifest)
+		}
+		config := &ImageConfig{}
+		if err = json.Unmarshal(blobOf(t, files, *manifest.Config), config); err != nil {
+			t.Fatalf("invalid config %v", err)
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest.Layers) || config.Config.Cmd[0] != "sh" {
+			t.Fatalf("unexpected config %+v", config)
+		}
+		// 层都经过 gzip 压缩，解压后的摘要和 diff id 一致
+		for i, layer := range manifest.Layers {
+			if layer.MediaType != MediaTypeLayerGzip {
+				t.Fatalf("layer %s should be gzip compressed", layer.Digest)
+			}
+			gr, err := gzip.NewReader(bytes.NewReader(blobOf(t, files, layer)))
+			if err != nil {
+				t.Fatalf("open gzip layer %v", err)
+			}
+			uncompressed, err := io.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("read gzip layer %v", err)
+			}
+			if digestPrefix+sha256Hex(uncompressed) != config.RootFS.DiffIDs[i] {
+				t.Fatalf("layer %d diff id mismatch", i)
+			}
+		}
+	}
+
+	// 导出的结果可以再导入
+	output := path.Join(t.TempDir(), "out.tar")
+	writeTestFile(t, output, buf.Bytes())
+	loadStore := newTestStore(t)
+	loaded, err := loadStore.Load(output, "")
+	if err != nil {
+		t.Fatalf("load saved images %v", err)
+	}
+	if len(loaded) != 2 || loaded[0].Name != "app" || loaded[1].Name != "base" {
+		t.Fatalf("unexpected loaded images %v", loaded)
+	}
+	if _, err = os.Stat(loadStore.BlobPath(loaded[0].Image.Manifest.Layers[1].Digest)); err != nil {
+		t.Fatalf("loaded layer not found %v", err)
+	}
+}
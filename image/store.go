@@ -0,0 +1,773 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"mydocker/constant"
+	"mydocker/utils"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTag 未指定 tag 时使用的默认 tag
+	DefaultTag = "latest"
+	// 镜像引用和镜像 Id 的对应关系
+	repositoriesFile = "repositories.json"
+	// 镜像元数据目录，每个镜像一个 <id>.json
+	imageDBDir = "imagedb"
+	// 按内容摘要存放的层压缩包
+	blobDir = "blobs/sha256"
+	// ShortIDLength 展示给用户的镜像 Id 长度
+	ShortIDLength = 12
+	digestPrefix  = "sha256:"
+
+	// 镜像清单和层的媒体类型，和 OCI 镜像规范保持一致
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+var (
+	ErrImageNotFound = errors.New("image not found")
+	nameRegexp       = regexp.MustCompile(`^[a-z0-9]+([._/-][a-z0-9]+)*$`)
+	tagRegexp        = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// Image 镜像元数据
+type Image struct {
+	ID       string    `json:"id"`               // 镜像 Id，为镜像清单的 sha256 摘要，格式为 sha256:<hex>
+	Created  time.Time `json:"created"`          // 创建时间
+	Size     int64     `json:"size"`             // 所有层压缩包大小之和
+	Manifest *Manifest `json:"manifest"`         // 镜像清单
+	Parent   string    `json:"parent,omitempty"` // 父镜像 Id，由 commit 创建的镜像在父镜像的层之上增加一层
+}
+
+// Manifest 镜像清单，引用镜像配置，并按从最底层到最上层的顺序列出镜像的所有层
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        *Descriptor  `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Descriptor 指向 blobs/sha256 下的一个文件
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Summary image ls 展示的一行，同一个镜像有多个引用时每个引用一行
+type Summary struct {
+	Name  string
+	Tag   string
+	Image *Image
+}
+
+// Store 镜像元数据存储
+/*
+目录结构:
+- repositories.json: 镜像引用 name:tag 到镜像 Id 的映射
+- imagedb/<hex>.json: 镜像元数据，包括镜像清单
+- blobs/sha256/<hex>: 层压缩包，多个镜像可以共享同一个层
+第一次使用镜像存储时，之前直接放到 Root 下的 <name>.tar 会被导入为 <name>:latest，导入只进行一次，
+完成后在 repositories.json 中做标记。
+和 IPAM 一样，读写前对锁文件加 flock 排他锁，避免多个 mydocker 进程同时修改。
+*/
+type Store struct {
+	Root         string
+	Repositories map[string]string
+	// Layers 镜像解压后的层，为空时不解压
+	Layers *LayerStore
+	// legacyImported Root 下的 <name>.tar 是否已经导入过
+	legacyImported bool
+}
+
+// repositories repositories.json 的内容
+type repositories struct {
+	Repositories   map[string]string `json:"repositories"`
+	LegacyImported bool              `json:"legacyImported"`
+}
+
+// DefaultStore 默认使用 /var/lib/mydocker/image/ 作为镜像存储目录
+var DefaultStore = &Store{Root: utils.ImagePath, Layers: DefaultLayerStore}
+
+// ParseReference 解析 name[:tag] 格式的镜像引用，未指定 tag 时使用 latest
+func ParseReference(ref string) (name, tag string, err error) {
+	name, tag = ref, DefaultTag
+	// 只有最后一个 / 之后的冒号才是 tag 分隔符
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		name, tag = ref[:idx], ref[idx+1:]
+	}
+	if !nameRegexp.MatchString(name) {
+		return "", "", fmt.Errorf("invalid image name %s", name)
+	}
+	if !tagRegexp.MatchString(tag) {
+		return "", "", fmt.Errorf("invalid image tag %s", tag)
+	}
+	return name, tag, nil
+}
+
+// ShortID 去掉 sha256: 前缀后截取前 12 位
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, digestPrefix)
+	if len(id) > ShortIDLength {
+		return id[:ShortIDLength]
+	}
+	return id
+}
+
+// Get 根据 name[:tag] 或者镜像 Id(可以是前缀)查找镜像
+func (s *Store) Get(ref string) (img *Image, err error) {
+	err = s.withLock(func() error {
+		img, err = s.get(ref)
+		return err
+	})
+	return img, err
+}
+
+// List 列出所有镜像引用，按名字和 tag 排序
+func (s *Store) List() (summaries []*Summary, err error) {
+	err = s.withLock(func() error {
+		for ref, id := range s.Repositories {
+			img, err := s.loadImage(id)
+			if err != nil {
+				log.Errorf("load image %s of %s error %v", id, ref, err)
+				continue
+			}
+			name, tag, _ := ParseReference(ref)
+			summaries = append(summaries, &Summary{Name: name, Tag: tag, Image: img})
+		}
+		return nil
+	})
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Name != summaries[j].Name {
+			return summaries[i].Name < summaries[j].Name
+		}
+		return summaries[i].Tag < summaries[j].Tag
+	})
+	return summaries, err
+}
+
+// Create 以 layerTar 作为最上层创建镜像并标记为 ref，镜像的其他层来自 parent，parent 为空时创建只有一层的镜像
+// config 为空时使用 parent 的配置，压缩包会被移动到 blobs 目录下，ref 已经存在时指向新的镜像
+// 层和配置都相同的镜像已经存在时不创建新镜像，ref 指向已有的镜像
+func (s *Store) Create(ref string, parent *Image, layerTar string, config *ContainerConfig) (img *Image, err error) {
+	name, tag, err := ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	err = s.withLock(func() error {
+		img, err = s.create(parent, layerTar, config)
+		if err != nil {
+			return err
+		}
+		s.Repositories[name+":"+tag] = img.ID
+		return nil
+	})
+	return img, err
+}
+
+// Import 将 rootfs 压缩包导入为只有一层的新镜像并标记为 ref，r 的内容必须是 tar 或者 tar+gzip
+func (s *Store) Import(ref string, r io.Reader, config *ContainerConfig) (*Image, error) {
+	if _, _, err := ParseReference(ref); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.Root, constant.Perm0755); err != nil {
+		return nil, errors.Wrapf(err, "mkdir %s", s.Root)
+	}
+	tmpFile, err := os.CreateTemp(s.Root, "import-*.tmp")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp rootfs file")
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	// 复制的同时检查内容是否为合法的 tar
+	if err = checkTar(io.TeeReader(r, tmpFile)); err != nil {
+		return nil, err
+	}
+	return s.Create(ref, nil, tmpFile.Name(), config)
+}
+
+// Remove 删除镜像
+/*
+- ref 为 name[:tag] 时删除该引用，镜像没有其他引用时同时删除镜像
+- ref 为镜像 Id 时删除镜像以及指向它的所有引用
+返回被删除的镜像，只删除了引用时返回 nil
+*/
+func (s *Store) Remove(ref string) (removed *Image, err error) {
+	err = s.withLock(func() error {
+		img, err := s.get(ref)
+		if err != nil {
+			return err
+		}
+		if name, tag, err := ParseReference(ref); err == nil && s.Repositories[name+":"+tag] == img.ID {
+			delete(s.Repositories, name+":"+tag)
+			if len(s.references(img.ID)) > 0 {
+				return nil
+			}
+		}
+		removed = img
+		return s.delete(img)
+	})
+	return removed, err
+}
+
+// Prune 删除所有 inUse 返回 false 的镜像，返回被删除的镜像
+func (s *Store) Prune(inUse func(img *Image) bool) (removed []*Image, err error) {
+	err = s.withLock(func() error {
+		ids := make(map[string]bool)
+		for _, id := range s.Repositories {
+			ids[id] = true
+		}
+		files, err := os.ReadDir(path.Join(s.Root, imageDBDir))
+		if err != nil {
+			return errors.Wrap(err, "read image db")
+		}
+		// 没有任何引用的镜像也需要清理
+		for _, file := range files {
+			if path.Ext(file.Name()) == ".json" {
+				ids[digestPrefix+strings.TrimSuffix(file.Name(), ".json")] = true
+			}
+		}
+		for id := range ids {
+			img, err := s.loadImage(id)
+			if err != nil {
+				log.Errorf("load image %s error %v", id, err)
+				continue
+			}
+			if inUse(img) {
+				continue
+			}
+			if err = s.delete(img); err != nil {
+				return err
+			}
+			removed = append(removed, img)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// References 返回指向镜像的所有引用
+func (s *Store) References(id string) (refs []string, err error) {
+	err = s.withLock(func() error {
+		refs = s.references(id)
+		return nil
+	})
+	return refs, err
+}
+
+// Config 读取镜像配置
+func (s *Store) Config(img *Image) (*ImageConfig, error) {
+	configPath := s.BlobPath(img.Manifest.Config.Digest)
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read config of image %s", img.ID)
+	}
+	config := &ImageConfig{}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal config of image %s", img.ID)
+	}
+	return config, nil
+}
+
+// LayerDirs 返回镜像解压后的层目录，用作容器 overlayfs 的 lowerdir，同时记录镜像和容器对层的引用
+// overlayfs 的 lowerdir 中靠前的目录在上层，所以返回的目录从最上层到最底层排列
+func (s *Store) LayerDirs(img *Image, containerID string) ([]string, error) {
+	layers := img.Manifest.Layers
+	layerDirs := make([]string, 0, len(layers))
+	for i := len(layers) - 1; i >= 0; i-- {
+		layerDir, err := s.Layers.Acquire(layers[i].Digest, s.BlobPath(layers[i].Digest),
+			ImageHolder(img.ID), ContainerHolder(containerID))
+		if err != nil {
+			return nil, err
+		}
+		layerDirs = append(layerDirs, layerDir)
+	}
+	return layerDirs, nil
+}
+
+// ReleaseContainer 删除容器对层的引用，容器删除时调用
+func (s *Store) ReleaseContainer(containerID string) error {
+	return s.Layers.Release(ContainerHolder(containerID))
+}
+
+// BlobPath 摘要对应的 blob 文件路径
+func (s *Store) BlobPath(digest string) string {
+	return path.Join(s.Root, blobDir, strings.TrimPrefix(digest, digestPrefix))
+}
+
+func (s *Store) get(ref string) (*Image, error) {
+	if name, tag, err := ParseReference(ref); err == nil {
+		if id, exist := s.Repositories[name+":"+tag]; exist {
+			return s.loadImage(id)
+		}
+	}
+	// 按镜像 Id 前缀查找
+	prefix := strings.TrimPrefix(ref, digestPrefix)
+	if len(prefix) == 0 {
+		return nil, errors.Wrapf(ErrImageNotFound, "image %s", ref)
+	}
+	files, err := os.ReadDir(path.Join(s.Root, imageDBDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read image db")
+	}
+	var matched []string
+	for _, file := range files {
+		if hexID := strings.TrimSuffix(file.Name(), ".json"); strings.HasPrefix(hexID, prefix) {
+			matched = append(matched, hexID)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil, errors.Wrapf(ErrImageNotFound, "image %s", ref)
+	case 1:
+		return s.loadImage(digestPrefix + matched[0])
+	default:
+		return nil, fmt.Errorf("image id prefix %s is ambiguous", ref)
+	}
+}
+
+func (s *Store) references(id string) []string {
+	var refs []string
+	for ref, refID := range s.Repositories {
+		if refID == id {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// delete 删除镜像的所有引用、元数据以及不再被其他镜像使用的配置和层压缩包
+func (s *Store) delete(img *Image) error {
+	for _, ref := range s.references(img.ID) {
+		delete(s.Repositories, ref)
+	}
+	// 层还被容器使用时会保留到容器删除
+	if s.Layers != nil {
+		if err := s.Layers.Release(ImageHolder(img.ID)); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(s.imagePath(img.ID)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove image %s", img.ID)
+	}
+	used, err := s.usedBlobs()
+	if err != nil {
+		return err
+	}
+	for _, blob := range img.Manifest.blobs() {
+		if used[blob.Digest] {
+			continue
+		}
+		if err = os.Remove(s.BlobPath(blob.Digest)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove blob %s of image %s", blob.Digest, img.ID)
+		}
+	}
+	return nil
+}
+
+// usedBlobs 返回所有镜像清单引用的 blob
+func (s *Store) usedBlobs() (map[string]bool, error) {
+	files, err := os.ReadDir(path.Join(s.Root, imageDBDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "read image db")
+	}
+	used := make(map[string]bool)
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".json" {
+			continue
+		}
+		img, err := s.loadImage(digestPrefix + strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range img.Manifest.blobs() {
+			used[blob.Digest] = true
+		}
+	}
+	return used, nil
+}
+
+func (s *Store) create(parent *Image, layerTar string, containerConfig *ContainerConfig) (*Image, error) {
+	layer, diffID, err := s.addLayer(layerTar)
+	if err != nil {
+		return nil, err
+	}
+	config := newImageConfig(time.Now())
+	var layers []Descriptor
+	var parentID string
+	if parent != nil {
+		parentConfig, err := s.Config(parent)
+		if err != nil {
+			return nil, err
+		}
+		config.Config = parentConfig.Config
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, parentConfig.RootFS.DiffIDs...)
+		layers = append(layers, parent.Manifest.Layers...)
+		parentID = parent.ID
+	}
+	if containerConfig != nil {
+		config.Config = *containerConfig
+	}
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	layers = append(layers, layer)
+
+	configContent, err := json.Marshal(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal image config")
+	}
+	// 相同层和配置的镜像已经存在时保留原来的镜像
+	if exist, err := s.findImage(layers, config); err != nil || exist != nil {
+		return exist, err
+	}
+	return s.createImage(layers, configContent, config.Created, parentID)
+}
+
+// findImage 查找层和配置都和 config 相同的镜像，配置中的创建时间除外，不存在时返回 nil
+func (s *Store) findImage(layers []Descriptor, config *ImageConfig) (*Image, error) {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal image config")
+	}
+	files, err := os.ReadDir(path.Join(s.Root, imageDBDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read image db")
+	}
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".json" {
+			continue
+		}
+		img, err := s.loadImage(digestPrefix + strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if !sameLayers(img.Manifest.Layers, layers) {
+			continue
+		}
+		imgConfig, err := s.Config(img)
+		if err != nil {
+			return nil, err
+		}
+		// 序列化后比较，忽略 nil 和空切片的区别
+		imgConfig.Created = config.Created
+		if imgContent, err := json.Marshal(imgConfig); err == nil && bytes.Equal(imgContent, content) {
+			return img, nil
+		}
+	}
+	return nil, nil
+}
+
+func sameLayers(a, b []Descriptor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Digest != b[i].Digest {
+			return false
+		}
+	}
+	return true
+}
+
+// createImage 保存镜像配置，生成引用配置和 layers 的清单，并保存镜像元数据
+func (s *Store) createImage(layers []Descriptor, configContent []byte, created time.Time, parentID string) (*Image, error) {
+	configDesc, err := s.putBlob(configContent, MediaTypeConfig)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{SchemaVersion: 2, MediaType: MediaTypeManifest, Config: &configDesc, Layers: layers}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal manifest")
+	}
+	img := &Image{
+		ID:       bytesDigest(content),
+		Created:  created,
+		Manifest: manifest,
+		Parent:   parentID,
+	}
+	for _, l := range manifest.Layers {
+		img.Size += l.Size
+	}
+	if err = s.dumpImage(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// addLayer 将层压缩包移动到 blobs 目录下，返回层的描述以及 diff id
+func (s *Store) addLayer(layerTar string) (Descriptor, string, error) {
+	stat, err := os.Stat(layerTar)
+	if err != nil {
+		return Descriptor{}, "", errors.Wrapf(err, "stat %s", layerTar)
+	}
+	digest, err := fileDigest(layerTar)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	mediaType, err := layerMediaType(layerTar)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	diffID := digest
+	if mediaType == MediaTypeLayerGzip {
+		if diffID, err = layerDiffID(layerTar); err != nil {
+			return Descriptor{}, "", err
+		}
+	}
+	blobPath := s.BlobPath(digest)
+	if err = os.MkdirAll(path.Dir(blobPath), constant.Perm0755); err != nil {
+		return Descriptor{}, "", errors.Wrapf(err, "mkdir %s", path.Dir(blobPath))
+	}
+	if err = os.Rename(layerTar, blobPath); err != nil {
+		return Descriptor{}, "", errors.Wrapf(err, "move %s to %s", layerTar, blobPath)
+	}
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: stat.Size()}, diffID, nil
+}
+
+// putBlob 将内容保存为 blob
+func (s *Store) putBlob(content []byte, mediaType string) (Descriptor, error) {
+	digest := bytesDigest(content)
+	blobPath := s.BlobPath(digest)
+	if err := os.MkdirAll(path.Dir(blobPath), constant.Perm0755); err != nil {
+		return Descriptor{}, errors.Wrapf(err, "mkdir %s", path.Dir(blobPath))
+	}
+	if err := writeFileAtomic(blobPath, content); err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}, nil
+}
+
+// blobs 返回清单引用的所有 blob
+func (m *Manifest) blobs() []Descriptor {
+	return append([]Descriptor{*m.Config}, m.Layers...)
+}
+
+func newImageConfig(created time.Time) *ImageConfig {
+	return &ImageConfig{
+		Created:      created,
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS:       RootFS{Type: rootfsTypeLayers},
+	}
+}
+
+// importLegacyImages 导入直接放在 Root 下的 <name>.tar，导入为 <name>:latest，<name>:latest 已经存在时跳过
+// 导入失败的压缩包保留在原处，不会再次尝试导入
+func (s *Store) importLegacyImages() {
+	files, err := os.ReadDir(s.Root)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != ".tar" {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".tar")
+		if _, _, err = ParseReference(name); err != nil {
+			log.Warnf("skip legacy image %s: %v", file.Name(), err)
+			continue
+		}
+		if _, exist := s.Repositories[name+":"+DefaultTag]; exist {
+			log.Warnf("skip legacy image %s: %s:%s already exists", file.Name(), name, DefaultTag)
+			continue
+		}
+		img, err := s.create(nil, path.Join(s.Root, file.Name()), nil)
+		if err != nil {
+			log.Errorf("import legacy image %s error %v", file.Name(), err)
+			continue
+		}
+		s.Repositories[name+":"+DefaultTag] = img.ID
+		log.Infof("import legacy image %s as %s:%s", file.Name(), name, DefaultTag)
+	}
+}
+
+func (s *Store) loadImage(id string) (*Image, error) {
+	imgPath := s.imagePath(id)
+	content, err := os.ReadFile(imgPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(ErrImageNotFound, "image %s", id)
+		}
+		return nil, errors.Wrapf(err, "read %s", imgPath)
+	}
+	img := &Image{}
+	if err = json.Unmarshal(content, img); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal image %s", id)
+	}
+	if img.Manifest == nil || img.Manifest.Config == nil {
+		return nil, fmt.Errorf("image %s has no manifest or config", id)
+	}
+	return img, nil
+}
+
+func (s *Store) dumpImage(img *Image) error {
+	content, err := json.Marshal(img)
+	if err != nil {
+		return errors.Wrapf(err, "marshal image %s", img.ID)
+	}
+	return writeFileAtomic(s.imagePath(img.ID), content)
+}
+
+func (s *Store) imagePath(id string) string {
+	return path.Join(s.Root, imageDBDir, strings.TrimPrefix(id, digestPrefix)+".json")
+}
+
+// withLock 持有文件锁，加载镜像引用，还没有导入过遗留镜像时先导入，执行 fn 后写回镜像引用
+func (s *Store) withLock(fn func() error) error {
+	if err := os.MkdirAll(path.Join(s.Root, imageDBDir), constant.Perm0755); err != nil {
+		return errors.Wrapf(err, "mkdir %s", s.Root)
+	}
+	lockFile, err := os.OpenFile(path.Join(s.Root, ".lock"), os.O_CREATE|os.O_RDWR, constant.Perm0644)
+	if err != nil {
+		return errors.Wrap(err, "open image store lock file")
+	}
+	defer lockFile.Close()
+	if err = unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return errors.Wrap(err, "lock image store")
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	if err = s.load(); err != nil {
+		return err
+	}
+	if !s.legacyImported {
+		s.importLegacyImages()
+		s.legacyImported = true
+	}
+	if err = fn(); err != nil {
+		return err
+	}
+	return s.dump()
+}
+
+func (s *Store) load() error {
+	s.Repositories, s.legacyImported = map[string]string{}, false
+	reposPath := path.Join(s.Root, repositoriesFile)
+	content, err := os.ReadFile(reposPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "read %s", reposPath)
+	}
+	repos := &repositories{}
+	if err = json.Unmarshal(content, repos); err != nil {
+		return errors.Wrapf(err, "unmarshal %s", reposPath)
+	}
+	if repos.Repositories != nil {
+		s.Repositories = repos.Repositories
+	}
+	s.legacyImported = repos.LegacyImported
+	return nil
+}
+
+func (s *Store) dump() error {
+	content, err := json.Marshal(&repositories{Repositories: s.Repositories, LegacyImported: s.legacyImported})
+	if err != nil {
+		return errors.Wrap(err, "marshal repositories")
+	}
+	return writeFileAtomic(path.Join(s.Root, repositoriesFile), content)
+}
+
+// writeFileAtomic 先写临时文件再 rename，避免写到一半时文件损坏
+func writeFileAtomic(filePath string, content []byte) error {
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, constant.Perm0644); err != nil {
+		return errors.Wrapf(err, "write %s", tmpPath)
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+// bytesDigest 计算内容的 sha256 摘要，格式为 sha256:<hex>
+func bytesDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return digestPrefix + hex.EncodeToString(sum[:])
+}
+
+// layerMediaType 根据文件头判断层压缩包是否经过 gzip 压缩
+func layerMediaType(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "open %s", filePath)
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err = io.ReadFull(f, magic); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return MediaTypeLayerGzip, nil
+	}
+	return MediaTypeLayer, nil
+}
+
+// checkTar 读取完整的 tar 或者 tar+gzip，内容不合法时返回错误
+func checkTar(r io.Reader) error {
+	reader, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		if _, err = tr.Next(); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid rootfs tar")
+		}
+	}
+	// 读完 tar 结尾之后的填充
+	if _, err = io.Copy(io.Discard, r); err != nil {
+		return errors.Wrap(err, "read rootfs tar")
+	}
+	return nil
+}
+
+// layerDiffID 计算层解压后的摘要
+func layerDiffID(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "open %s", filePath)
+	}
+	defer f.Close()
+	reader, err := decompress(f)
+	if err != nil {
+		return "", errors.WithMessagef(err, "read %s", filePath)
+	}
+	defer reader.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, reader); err != nil {
+		return "", errors.Wrapf(err, "read %s", filePath)
+	}
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileDigest 计算文件内容的 sha256 摘要，格式为 sha256:<hex>
+func fileDigest(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "open %s", filePath)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "read %s", filePath)
+	}
+	return digestPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,279 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	return &Store{Root: t.TempDir()}
+}
+
+func writeTestTar(t *testing.T, filePath, content string) {
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("write %s %v", filePath, err)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	cases := map[string][2]string{
+		"busybox":               {"busybox", "latest"},
+		"busybox:1.36":          {"busybox", "1.36"},
+		"app/web":               {"app/web", "latest"},
+		"library/app:v1.0-rc_1": {"library/app", "v1.0-rc_1"},
+	}
+	for ref, expect := range cases {
+		name, tag, err := ParseReference(ref)
+		if err != nil {
+			t.Fatalf("parse %s %v", ref, err)
+		}
+		if name != expect[0] || tag != expect[1] {
+			t.Fatalf("parse %s expect %v got %s %s", ref, expect, name, tag)
+		}
+	}
+	for _, ref := range []string{"", "Busybox", "busybox:", "a:b:c", "-app"} {
+		if _, _, err := ParseReference(ref); err == nil {
+			t.Fatalf("parse %s should fail", ref)
+		}
+	}
+}
+
+func TestStoreCreateAndGet(t *testing.T) {
+	s := newTestStore(t)
+	// 直接放在镜像目录下的压缩包会被导入为 <name>:latest
+	writeTestTar(t, path.Join(s.Root, "legacy.tar"), "legacy rootfs")
+	tmp := path.Join(s.Root, "new.tmp")
+	writeTestTar(t, tmp, "new rootfs")
+	img, err := s.Create("app:v1", nil, tmp, nil)
+	if err != nil {
+		t.Fatalf("create %v", err)
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("rootfs tar should be moved into store")
+	}
+	if _, err = os.Stat(s.BlobPath(img.Manifest.Layers[0].Digest)); err != nil {
+		t.Fatalf("rootfs blob not found %v", err)
+	}
+
+	byTag, err := s.Get("app:v1")
+	if err != nil || byTag.ID != img.ID {
+		t.Fatalf("get by tag %v %v", byTag, err)
+	}
+	byID, err := s.Get(ShortID(img.ID))
+	if err != nil || byID.ID != img.ID {
+		t.Fatalf("get by id %v %v", byID, err)
+	}
+	if _, err = s.Get("app"); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("app:latest should not exist, got %v", err)
+	}
+
+	summaries, err := s.List()
+	if err != nil {
+		t.Fatalf("list %v", err)
+	}
+	if len(summaries) != 2 || summaries[0].Name != "app" || summaries[1].Name != "legacy" {
+		t.Fatalf("unexpected summaries %v", summaries)
+	}
+	if summaries[1].Tag != DefaultTag || summaries[1].Image.Size != int64(len("legacy rootfs")) {
+		t.Fatalf("unexpected legacy image %+v", summaries[1].Image)
+	}
+}
+
+func TestStoreRemoveAndPrune(t *testing.T) {
+	s := newTestStore(t)
+	for ref, content := range map[string]string{"app:v1": "app", "base:latest": "base", "tmp:latest": "tmp"} {
+		tmp := path.Join(s.Root, ref+".tmp")
+		writeTestTar(t, tmp, content)
+		if _, err := s.Create(ref, nil, tmp, nil); err != nil {
+			t.Fatalf("create %s %v", ref, err)
+		}
+	}
+	// 同一个镜像的第二个引用
+	tmp := path.Join(s.Root, "app.tmp")
+	writeTestTar(t, tmp, "app")
+	app, err := s.Create("app:v2", nil, tmp, nil)
+	if err != nil {
+		t.Fatalf("create app:v2 %v", err)
+	}
+
+	// 还有其他引用时只删除引用
+	if removed, err := s.Remove("app:v1"); err != nil || removed != nil {
+		t.Fatalf("remove app:v1 should only untag, got %v %v", removed, err)
+	}
+	if removed, err := s.Remove("app:v2"); err != nil || removed == nil || removed.ID != app.ID {
+		t.Fatalf("remove app:v2 should delete image, got %v %v", removed, err)
+	}
+	if _, err = os.Stat(s.BlobPath(app.Manifest.Layers[0].Digest)); !os.IsNotExist(err) {
+		t.Fatalf("rootfs of removed image should be deleted")
+	}
+
+	base, _ := s.Get("base")
+	removed, err := s.Prune(func(img *Image) bool { return img.ID == base.ID })
+	if err != nil {
+		t.Fatalf("prune %v", err)
+	}
+	if len(removed) != 1 {
+		t.Fatalf("expect 1 image pruned, got %v", removed)
+	}
+	summaries, _ := s.List()
+	if len(summaries) != 1 || summaries[0].Name != "base" {
+		t.Fatalf("only base should be kept, got %v", summaries)
+	}
+}
+
+func TestStoreMultiLayerImage(t *testing.T) {
+	s := newTestStore(t)
+	s.Layers = &LayerStore{Root: t.TempDir()}
+	base, err := s.Create("base", nil, createTestLayer(t, "base", "base"), nil)
+	if err != nil {
+		t.Fatalf("create base %v", err)
+	}
+	app, err := s.Create("app", base, createTestLayer(t, "app", "app"), nil)
+	if err != nil {
+		t.Fatalf("create app %v", err)
+	}
+	if len(app.Manifest.Layers) != 2 || app.Manifest.Layers[0] != base.Manifest.Layers[0] {
+		t.Fatalf("app should reference base layer, got %+v", app.Manifest.Layers)
+	}
+	if app.Size != app.Manifest.Layers[0].Size+app.Manifest.Layers[1].Size {
+		t.Fatalf("unexpected size %d", app.Size)
+	}
+
+	// 最上层的目录排在最前面
+	dirs, err := s.LayerDirs(app, "c1")
+	if err != nil {
+		t.Fatalf("layer dirs %v", err)
+	}
+	if len(dirs) != 2 {
+		t.Fatalf("expect 2 layer dirs, got %v", dirs)
+	}
+	if _, err = os.Stat(path.Join(dirs[0], "app")); err != nil {
+		t.Fatalf("first dir should be top layer %v", err)
+	}
+	if _, err = os.Stat(path.Join(dirs[1], "base")); err != nil {
+		t.Fatalf("last dir should be base layer %v", err)
+	}
+
+	// 删除 app 时保留 base 还在使用的层
+	if _, err = s.Remove("app"); err != nil {
+		t.Fatalf("remove app %v", err)
+	}
+	if _, err = os.Stat(s.BlobPath(base.Manifest.Layers[0].Digest)); err != nil {
+		t.Fatalf("base layer should be kept %v", err)
+	}
+	if _, err = os.Stat(s.BlobPath(app.Manifest.Layers[1].Digest)); !os.IsNotExist(err) {
+		t.Fatalf("app layer should be deleted")
+	}
+}
+
+func TestStoreImageConfig(t *testing.T) {
+	s := newTestStore(t)
+	baseConfig := &ContainerConfig{Cmd: []string{"sh"}, Env: []string{"PATH=/bin"}}
+	base, err := s.Create("base", nil, createTestLayer(t, "base", "base"), baseConfig)
+	if err != nil {
+		t.Fatalf("create base %v", err)
+	}
+	// 未指定配置时继承父镜像的配置
+	app, err := s.Create("app", base, createTestLayer(t, "app", "app"), nil)
+	if err != nil {
+		t.Fatalf("create app %v", err)
+	}
+	config, err := s.Config(app)
+	if err != nil {
+		t.Fatalf("config %v", err)
+	}
+	if len(config.Config.Cmd) != 1 || config.Config.Cmd[0] != "sh" || len(config.Config.Env) != 1 {
+		t.Fatalf("config should be inherited from base, got %+v", config.Config)
+	}
+	if len(config.RootFS.DiffIDs) != 2 || config.RootFS.DiffIDs[1] != app.Manifest.Layers[1].Digest {
+		t.Fatalf("unexpected diff ids %v", config.RootFS.DiffIDs)
+	}
+	if app.Manifest.Config == nil || app.Manifest.Config.MediaType != MediaTypeConfig {
+		t.Fatalf("manifest should reference config, got %+v", app.Manifest.Config)
+	}
+
+	// 配置只被 app 使用，删除 app 时一起删除
+	if _, err = s.Remove("app"); err != nil {
+		t.Fatalf("remove app %v", err)
+	}
+	if _, err = os.Stat(s.BlobPath(app.Manifest.Config.Digest)); !os.IsNotExist(err) {
+		t.Fatalf("config of removed image should be deleted")
+	}
+}
+
+func TestStoreImport(t *testing.T) {
+	s := newTestStore(t)
+	rootfs := gzipBytes(t, tarBytes(t, map[string]string{"bin/sh": "sh"}))
+	img, err := s.Import("rootfs:v1", bytes.NewReader(rootfs), &ContainerConfig{Cmd: []string{"/bin/sh"}})
+	if err != nil {
+		t.Fatalf("import %v", err)
+	}
+	if len(img.Manifest.Layers) != 1 || img.Manifest.Layers[0].Digest != digestPrefix+sha256Hex(rootfs) {
+		t.Fatalf("unexpected layers %+v", img.Manifest.Layers)
+	}
+	if config, err := s.Config(img); err != nil || config.Config.Cmd[0] != "/bin/sh" {
+		t.Fatalf("unexpected config %+v %v", config, err)
+	}
+
+	if _, err = s.Import("broken", bytes.NewReader([]byte("not a tar")), nil); err == nil {
+		t.Fatalf("import invalid tar should fail")
+	}
+	if _, err = s.Get("broken"); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("invalid tar should not be registered, got %v", err)
+	}
+}
+
+func TestStoreCreateSameContent(t *testing.T) {
+	s := newTestStore(t)
+	newLayer := func() string {
+		layerPath := path.Join(t.TempDir(), "layer.tar")
+		writeTestTar(t, layerPath, "app")
+		return layerPath
+	}
+	config := &ContainerConfig{Cmd: []string{"sh"}}
+	first, err := s.Create("app:v1", nil, newLayer(), config)
+	if err != nil {
+		t.Fatalf("create app:v1 %v", err)
+	}
+	// 相同的层和配置复用已有的镜像
+	second, err := s.Create("app:v2", nil, newLayer(), &ContainerConfig{Cmd: []string{"sh"}})
+	if err != nil || second.ID != first.ID || !second.Created.Equal(first.Created) {
+		t.Fatalf("same content should keep image %s, got %+v %v", first.ID, second, err)
+	}
+	// 配置不同时创建新镜像
+	third, err := s.Create("app:v3", nil, newLayer(), &ContainerConfig{Cmd: []string{"bash"}})
+	if err != nil || third.ID == first.ID {
+		t.Fatalf("different config should create new image, got %+v %v", third, err)
+	}
+}
+
+func TestStoreImportLegacyImagesOnce(t *testing.T) {
+	s := newTestStore(t)
+	writeTestTar(t, path.Join(s.Root, "a.tar"), "a rootfs")
+	// 只有 b:latest 的 repositories.json 也需要导入遗留镜像，b.tar 因为 b:latest 已经存在被跳过
+	writeTestTar(t, path.Join(s.Root, repositoriesFile), `{"repositories":{"b:latest":"sha256:b"}}`)
+	writeTestTar(t, path.Join(s.Root, "b.tar"), "b rootfs")
+	a, err := s.Get("a")
+	if err != nil {
+		t.Fatalf("a.tar should be imported, got %v", err)
+	}
+	if refs, _ := s.References("sha256:b"); len(refs) != 1 || refs[0] != "b:latest" {
+		t.Fatalf("b:latest should be kept, got %v", refs)
+	}
+	if _, err = os.Stat(path.Join(s.Root, "b.tar")); err != nil {
+		t.Fatalf("skipped b.tar should be kept %v", err)
+	}
+
+	// 导入只进行一次，之后放入的压缩包不会再被导入
+	writeTestTar(t, path.Join(s.Root, "a.tar"), "new a rootfs")
+	writeTestTar(t, path.Join(s.Root, "new.tar"), "new rootfs")
+	if img, err := s.Get("a"); err != nil || img.ID != a.ID {
+		t.Fatalf("a:latest should not be retagged, got %+v %v", img, err)
+	}
+	if _, err = s.Get("new"); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("new.tar should not be imported, got %v", err)
+	}
+}
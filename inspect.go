@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// inspectContainer 以 JSON 格式打印容器信息
+func inspectContainer(containerId string) error {
+	containerInfo, err := getInfoByContainerId(containerId)
+	if err != nil {
+		return errors.WithMessagef(err, "get container %s info", containerId)
+	}
+	content, err := json.MarshalIndent(containerInfo, "", "    ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal container %s info", containerId)
+	}
+	fmt.Println(string(content))
+	return nil
+}
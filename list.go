@@ -3,44 +3,39 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"mydocker/container"
+	"mydocker/network"
 	"os"
 	"path"
+	"strings"
 	"text/tabwriter"
 )
 
 func ListContainers() {
-	// 读取存放容器信息目录下的所有文件
-	files, err := os.ReadDir(container.InfoLoc)
+	containers, err := getAllContainerInfo()
 	if err != nil {
-		log.Errorf("read dir %s error %v", container.InfoLoc, err)
+		log.Errorf("%v", err)
 		return
 	}
-	containers := make([]*container.Info, 0, len(files))
-	for _, file := range files {
-		tmpContainer, err := getContainerInfo(file)
-		if err != nil {
-			log.Errorf("get container info error %v", err)
-			continue
-		}
-		containers = append(containers, tmpContainer)
-	}
 	// 使用tabwriter.NewWriter在控制台打印出容器信息
 	// tabwriter 是引用的text/tabwriter类库，用于在控制台打印对齐的表格
 	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	_, err = fmt.Fprint(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\n")
+	_, err = fmt.Fprint(w, "ID\tNAME\tHOSTNAME\tPID\tSTATUS\tCOMMAND\tCREATED\tPORTS\n")
 	if err != nil {
 		log.Errorf("Fprint error %v", err)
 	}
 	for _, item := range containers {
-		_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+		_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			item.Id,
 			item.Name,
+			item.Hostname,
 			item.Pid,
 			item.Status,
 			item.Command,
-			item.CreatedTime)
+			item.CreatedTime,
+			formatPorts(item.PortMapping))
 		if err != nil {
 			log.Errorf("Fprint error %v", err)
 		}
@@ -51,6 +46,27 @@ func ListContainers() {
 	}
 }
 
+// getAllContainerInfo 读取存放容器信息目录下的所有容器信息
+func getAllContainerInfo() ([]*container.Info, error) {
+	files, err := os.ReadDir(container.InfoLoc)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read dir %s", container.InfoLoc)
+	}
+	containers := make([]*container.Info, 0, len(files))
+	for _, file := range files {
+		tmpContainer, err := getContainerInfo(file)
+		if err != nil {
+			log.Errorf("get container info error %v", err)
+			continue
+		}
+		containers = append(containers, tmpContainer)
+	}
+	return containers, nil
+}
+
 func getContainerInfo(file os.DirEntry) (*container.Info, error) {
 	// 根据文件名拼接出完整路径
 	configFileDir := fmt.Sprintf(container.InfoLocFormat, file.Name())
@@ -69,3 +85,17 @@ func getContainerInfo(file os.DirEntry) (*container.Info, error) {
 
 	return info, nil
 }
+
+// formatPorts 将端口映射格式化为 0.0.0.0:8080->80/tcp 的形式
+func formatPorts(portMapping []string) string {
+	ports := make([]string, 0, len(portMapping))
+	for _, raw := range portMapping {
+		pm, err := network.ParsePortMapping(raw)
+		if err != nil {
+			ports = append(ports, raw)
+			continue
+		}
+		ports = append(ports, fmt.Sprintf("0.0.0.0:%d->%d/%s", pm.HostPort, pm.ContainerPort, pm.Protocol))
+	}
+	return strings.Join(ports, ", ")
+}
@@ -17,13 +17,25 @@ func MyDocker() {
 
 	app.Commands = []cli.Command{
 		initCommand,
+		proxyCommand,
+		dnsCommand,
 		runCommand,
 		commitCommand,
+		exportCommand,
+		importCommand,
 		listCommand,
+		inspectCommand,
 		logCommand,
 		execCommand,
 		stopCommand,
 		removeCommand,
+		updateCommand,
+		networkCommand,
+		netAttachCommand,
+		netDetachCommand,
+		netStatCommand,
+		imageCommand,
+		imagesCommand,
 	}
 
 	app.Before = func(context *cli.Context) error {
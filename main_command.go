@@ -6,19 +6,65 @@ import (
 	"github.com/urfave/cli"
 	"mydocker/cgroups/subsystems"
 	"mydocker/container"
+	"mydocker/dns"
+	"mydocker/network"
 	"os"
 )
 
 var commitCommand = cli.Command{
 	Name:  "commit",
 	Usage: "commit container to image",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "change, c",
+			Usage: "apply instruction to the image config,e.g. -change 'CMD top' -change 'ENV A=1'",
+		},
+	},
 	Action: func(context *cli.Context) error {
 		if len(context.Args()) < 1 {
 			return fmt.Errorf("missing image name")
 		}
 		containerID := context.Args().Get(0)
 		imageName := context.Args().Get(1)
-		return commitContainer(containerID, imageName)
+		return commitContainer(containerID, imageName, context.StringSlice("change"))
+	},
+}
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "export filesystem of a container as a tar archive,e.g. mydocker export 1234567890 -o rootfs.tar",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "o",
+			Usage: "output tar file, - for stdout",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		output := context.String("o")
+		if output == "" {
+			return fmt.Errorf("missing output, please specify -o")
+		}
+		return exportContainer(context.Args().Get(0), output)
+	},
+}
+
+var importCommand = cli.Command{
+	Name:  "import",
+	Usage: "import a rootfs tarball as a new image,e.g. mydocker import rootfs.tar busybox:latest",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "change, c",
+			Usage: "apply instruction to the image config,e.g. -change 'CMD sh'",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 2 {
+			return fmt.Errorf("missing rootfs tarball or image name")
+		}
+		return importImage(context.Args().Get(0), context.Args().Get(1), context.StringSlice("change"))
 	},
 }
 
@@ -47,7 +93,7 @@ var logCommand = cli.Command{
 var runCommand = cli.Command{
 	Name: "run",
 	Usage: `Create a container with namespace and cgroups limit
-			mydocker run -it [command]`,
+			mydocker run -it image [command]，未指定命令时使用镜像的 Entrypoint 和 Cmd`,
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:  "it", // 简单起见，这里把 -i 和 -t 参数合并成一个
@@ -85,6 +131,50 @@ var runCommand = cli.Command{
 			Name:  "e",
 			Usage: "set environment,e.g. -e name=mydocker",
 		},
+		cli.StringFlag{
+			Name:  "net",
+			Usage: "container network,e.g. -net bridge, -net mynet, -net none, -net host, -net container:1234567890, -net macvlan:eth0,192.168.1.10/24[,192.168.1.1] or -net cni:mycni",
+		},
+		cli.StringSliceFlag{
+			Name:  "p",
+			Usage: "port mapping,e.g. -p 8080:80 -p 53:53/udp",
+		},
+		cli.BoolFlag{
+			Name:  "userland-proxy",
+			Usage: "publish ports with userland proxy instead of iptables",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "set custom dns servers,e.g. -dns 114.114.114.114",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "set custom dns search domains,e.g. -dns-search example.com",
+		},
+		cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "add a custom host-to-IP mapping,e.g. -add-host myhost:10.0.0.1",
+		},
+		cli.StringSliceFlag{
+			Name:  "alias",
+			Usage: "add network-scoped alias for the container,e.g. -alias db",
+		},
+		cli.StringFlag{
+			Name:  "hostname",
+			Usage: "container hostname,default is container name or id,e.g. -hostname myhost",
+		},
+		cli.BoolFlag{
+			Name:  "ipv6",
+			Usage: "allocate container ipv6 address from the ipv6 subnet of the bridge network",
+		},
+		cli.StringFlag{
+			Name:  "net-rate",
+			Usage: "egress bandwidth limit of container network,e.g. -net-rate 10mbit",
+		},
+		cli.StringFlag{
+			Name:  "net-ingress-rate",
+			Usage: "ingress bandwidth limit of container network,e.g. -net-ingress-rate 10mbit",
+		},
 	},
 	/*
 		这里是run命令执行的真正函数。
@@ -94,7 +184,7 @@ var runCommand = cli.Command{
 	*/
 	Action: func(context *cli.Context) error {
 		if len(context.Args()) < 1 {
-			return fmt.Errorf("missing container command")
+			return fmt.Errorf("missing image name")
 		}
 		var cmdArray []string
 		for _, arg := range context.Args() {
@@ -116,12 +206,42 @@ var runCommand = cli.Command{
 			MemorySwapLimit: context.Int("memswap"),
 			CpuSet:          context.String("cpuset"),
 			CpuCfsQuota:     context.Int("cpu"),
+			NetRate:         context.String("net-rate"),
+			NetIngressRate:  context.String("net-ingress-rate"),
 		}
 		log.Info("resConf:", resConf)
-		volume := context.String("v")
-		containerName := context.String("name")
-		envSlice := context.StringSlice("e")
-		Run(tty, cmdArray, resConf, volume, containerName, imageName, envSlice)
+		opts := &RunOptions{
+			Tty:           tty,
+			Cmd:           cmdArray,
+			Resource:      resConf,
+			Volume:        context.String("v"),
+			ContainerName: context.String("name"),
+			ImageName:     imageName,
+			Hostname:      context.String("hostname"),
+			Env:           context.StringSlice("e"),
+			Net:           context.String("net"),
+			PortMapping:   context.StringSlice("p"),
+			UserlandProxy: context.Bool("userland-proxy"),
+			DNS: &container.DNSConfig{
+				Nameservers: context.StringSlice("dns"),
+				Search:      context.StringSlice("dns-search"),
+				ExtraHosts:  context.StringSlice("add-host"),
+			},
+			Aliases: context.StringSlice("alias"),
+			IPv6:    context.Bool("ipv6"),
+		}
+		netMode, _ := container.ParseNetMode(opts.Net)
+		if len(opts.PortMapping) > 0 && netMode != container.NetModeBridge {
+			return fmt.Errorf("port mapping requires a bridge network, please specify -net")
+		}
+		if opts.IPv6 && netMode != container.NetModeBridge {
+			return fmt.Errorf("ipv6 requires a bridge network, please specify -net")
+		}
+		if (resConf.NetRate != "" || resConf.NetIngressRate != "") &&
+			(netMode == container.NetModeHost || netMode == container.NetModeContainer) {
+			return fmt.Errorf("bandwidth limit is not supported in %s network mode", netMode)
+		}
+		Run(opts)
 		return nil
 	},
 }
@@ -136,6 +256,49 @@ var initCommand = cli.Command{
 	},
 }
 
+var proxyCommand = cli.Command{
+	Name:  "proxy",
+	Usage: "Userland proxy forward host port to container. Do not call it outside",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "proto",
+			Value: "tcp",
+		},
+		cli.IntFlag{
+			Name: "host-port",
+		},
+		cli.StringFlag{
+			Name: "container-ip",
+		},
+		cli.IntFlag{
+			Name: "container-port",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		log.Infof("proxy %s 0.0.0.0:%d -> %s:%d", context.String("proto"), context.Int("host-port"),
+			context.String("container-ip"), context.Int("container-port"))
+		return network.RunUserlandProxy(context.String("proto"), context.Int("host-port"),
+			context.String("container-ip"), context.Int("container-port"))
+	},
+}
+
+var dnsCommand = cli.Command{
+	Name:  "dns",
+	Usage: "Embedded dns server for container network. Do not call it outside",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "network",
+		},
+		cli.StringFlag{
+			Name: "listen",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		log.Infof("dns of network %s listen on %s", context.String("network"), context.String("listen"))
+		return dns.NewServer(context.String("network")).ListenAndServe(context.String("listen"))
+	},
+}
+
 var execCommand = cli.Command{
 	Name:  "exec",
 	Usage: "exec a command into container",
@@ -157,6 +320,17 @@ var execCommand = cli.Command{
 	},
 }
 
+var inspectCommand = cli.Command{
+	Name:  "inspect",
+	Usage: "show container detail,e.g. mydocker inspect 1234567890",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		return inspectContainer(context.Args().Get(0))
+	},
+}
+
 var stopCommand = cli.Command{
 	Name:  "stop",
 	Usage: "stop a container,e.g. mydocker stop 1234567890",
@@ -189,3 +363,256 @@ var removeCommand = cli.Command{
 		return nil
 	},
 }
+
+var updateCommand = cli.Command{
+	Name:  "update",
+	Usage: "update resource limit of running container,e.g. mydocker update 1234567890 -net-rate 5mbit",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "net-rate",
+			Usage: "egress bandwidth limit of container network, 0 means no limit",
+		},
+		cli.StringFlag{
+			Name:  "net-ingress-rate",
+			Usage: "ingress bandwidth limit of container network, 0 means no limit",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		if !context.IsSet("net-rate") && !context.IsSet("net-ingress-rate") {
+			return fmt.Errorf("nothing to update")
+		}
+		var netRate, netIngressRate *string
+		if context.IsSet("net-rate") {
+			rate := context.String("net-rate")
+			netRate = &rate
+		}
+		if context.IsSet("net-ingress-rate") {
+			rate := context.String("net-ingress-rate")
+			netIngressRate = &rate
+		}
+		return updateContainer(context.Args().Get(0), netRate, netIngressRate)
+	},
+}
+
+var netStatCommand = cli.Command{
+	Name:  "netstat",
+	Usage: "show network traffic statistics of running container,e.g. mydocker netstat 1234567890",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		return showNetStats(context.Args().Get(0))
+	},
+}
+
+var netAttachCommand = cli.Command{
+	Name:  "netattach",
+	Usage: "attach a network interface to running container,e.g. mydocker netattach 1234567890 --bridge br0 --ip 10.1.0.5/24",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "bridge",
+			Usage: "host bridge the interface connect to, created if not exist",
+		},
+		cli.StringFlag{
+			Name:  "ip",
+			Usage: "address of the interface in container, cidr format",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		if context.String("bridge") == "" || context.String("ip") == "" {
+			return fmt.Errorf("--bridge and --ip are required")
+		}
+		return attachNetwork(context.Args().Get(0), context.String("bridge"), context.String("ip"))
+	},
+}
+
+var netDetachCommand = cli.Command{
+	Name:  "netdetach",
+	Usage: "detach a network interface added by netattach,e.g. mydocker netdetach 1234567890 --ifname eth1",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "ifname",
+			Usage: "interface name in container",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		if context.String("ifname") == "" {
+			return fmt.Errorf("missing --ifname")
+		}
+		return detachNetwork(context.Args().Get(0), context.String("ifname"))
+	},
+}
+
+var networkCommand = cli.Command{
+	Name:  "network",
+	Usage: "container network commands",
+	Subcommands: []cli.Command{
+		{
+			Name:  "create",
+			Usage: "create a container network,e.g. mydocker network create --driver bridge --subnet 10.20.0.0/24 mynet",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "driver",
+					Value: "bridge",
+					Usage: "network driver",
+				},
+				cli.StringFlag{
+					Name:  "subnet",
+					Usage: "subnet cidr",
+				},
+				cli.StringFlag{
+					Name:  "ipv6-subnet",
+					Usage: "enable ipv6 on the network with subnet cidr,e.g. --ipv6-subnet fd00:10::/64",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				if context.String("subnet") == "" {
+					return fmt.Errorf("missing subnet")
+				}
+				return createNetwork(context.String("driver"), context.String("subnet"), context.String("ipv6-subnet"),
+					context.Args()[0])
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list container network",
+			Action: func(context *cli.Context) error {
+				return listNetworks()
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "remove container network,e.g. mydocker network rm mynet",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				return removeNetwork(context.Args()[0])
+			},
+		},
+		{
+			Name:  "check",
+			Usage: "check cni network of container by plugin CHECK,e.g. mydocker network check 1234567890",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing container id")
+				}
+				return checkCNINetwork(context.Args()[0])
+			},
+		},
+		{
+			Name:  "inspect",
+			Usage: "show network detail,e.g. mydocker network inspect mynet",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				return inspectNetwork(context.Args()[0])
+			},
+		},
+	},
+}
+
+var imageCommand = cli.Command{
+	Name:  "image",
+	Usage: "manage images",
+	Subcommands: []cli.Command{
+		{
+			Name:  "ls",
+			Usage: "list images",
+			Action: func(context *cli.Context) error {
+				return listImages()
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "remove image,e.g. mydocker image rm busybox:latest",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "f",
+					Usage: "force remove image used by containers",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing image name")
+				}
+				for _, ref := range context.Args() {
+					if err := removeImage(ref, context.Bool("f")); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "load",
+			Usage: "load images from docker save archive or oci image layout,e.g. mydocker image load -i busybox.tar",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "i",
+					Usage: "input tar file or oci image layout directory",
+				},
+				cli.StringFlag{
+					Name:  "t",
+					Usage: "reference for images without name in the archive,e.g. -t busybox:latest",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				input := context.String("i")
+				if input == "" {
+					return fmt.Errorf("missing input, please specify -i")
+				}
+				return loadImages(input, context.String("t"))
+			},
+		},
+		{
+			Name:  "save",
+			Usage: "save images to a tar archive in oci image layout,e.g. mydocker image save -o busybox.tar busybox",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "o",
+					Usage: "output tar file",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("missing image name")
+				}
+				output := context.String("o")
+				if output == "" {
+					return fmt.Errorf("missing output, please specify -o")
+				}
+				return saveImages(output, context.Args())
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "remove all images not used by any container",
+			Action: func(context *cli.Context) error {
+				return pruneImages()
+			},
+		},
+	},
+}
+
+// imagesCommand image ls 的简写
+var imagesCommand = cli.Command{
+	Name:  "images",
+	Usage: "list images, alias of image ls",
+	Action: func(context *cli.Context) error {
+		return listImages()
+	},
+}
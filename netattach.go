@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"mydocker/container"
+	"mydocker/network"
+	"strconv"
+)
+
+// attachNetwork 为运行中的容器热插拔一块连接到 bridge 的网卡，并记录到容器信息中
+func attachNetwork(containerId, bridge, cidr string) error {
+	containerInfo, pid, err := getRunningContainer(containerId)
+	if err != nil {
+		return err
+	}
+	iface, err := network.AttachInterface(bridge, containerInfo.Id, pid, cidr)
+	if err != nil {
+		return errors.WithMessagef(err, "attach bridge %s to container %s", bridge, containerId)
+	}
+	// 新网卡同样需要遵守容器的带宽限制
+	netMode, _ := container.ParseNetMode(containerInfo.NetMode)
+	if err = setNetworkBandwidth(pid, netMode, containerInfo.Resource); err != nil {
+		log.Errorf("Set network bandwidth of container %s error %v", containerId, err)
+	}
+	containerInfo.Interfaces = append(containerInfo.Interfaces, iface)
+	if err = updateContainerInfo(containerInfo); err != nil {
+		_ = network.DetachInterface(iface)
+		return err
+	}
+	fmt.Println(iface.Name)
+	return nil
+}
+
+// detachNetwork 删除容器中通过 netattach 添加的网卡 ifName
+func detachNetwork(containerId, ifName string) error {
+	containerInfo, _, err := getRunningContainer(containerId)
+	if err != nil {
+		return err
+	}
+	for i, iface := range containerInfo.Interfaces {
+		if iface.Name != ifName {
+			continue
+		}
+		if err = network.DetachInterface(iface); err != nil {
+			return errors.WithMessagef(err, "detach %s from container %s", ifName, containerId)
+		}
+		containerInfo.Interfaces = append(containerInfo.Interfaces[:i], containerInfo.Interfaces[i+1:]...)
+		return updateContainerInfo(containerInfo)
+	}
+	return fmt.Errorf("interface %s not attached to container %s", ifName, containerId)
+}
+
+// getRunningContainer 查询运行中的容器信息以及 init 进程的 PID
+func getRunningContainer(containerId string) (*container.Info, int, error) {
+	containerInfo, err := getInfoByContainerId(containerId)
+	if err != nil {
+		return nil, 0, errors.WithMessagef(err, "get container %s info", containerId)
+	}
+	if containerInfo.Status != container.RUNNING {
+		return nil, 0, fmt.Errorf("container %s is not running", containerId)
+	}
+	pid, err := strconv.Atoi(containerInfo.Pid)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "convert pid %s", containerInfo.Pid)
+	}
+	return containerInfo, pid, nil
+}
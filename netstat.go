@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"mydocker/network"
+	"os"
+	"text/tabwriter"
+)
+
+// showNetStats 打印运行中容器每块网卡的流量统计
+func showNetStats(containerId string) error {
+	_, pid, err := getRunningContainer(containerId)
+	if err != nil {
+		return err
+	}
+	stats, err := network.GetInterfaceStats(pid)
+	if err != nil {
+		return errors.WithMessagef(err, "get network stats of container %s", containerId)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	_, _ = fmt.Fprint(w, "INTERFACE\tRX BYTES\tRX PACKETS\tRX ERRORS\tRX DROPPED\tTX BYTES\tTX PACKETS\tTX ERRORS\tTX DROPPED\n")
+	for _, s := range stats {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", s.Name, s.RxBytes, s.RxPackets, s.RxErrors,
+			s.RxDropped, s.TxBytes, s.TxPackets, s.TxErrors, s.TxDropped)
+	}
+	if err = w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+	return nil
+}
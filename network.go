@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"mydocker/container"
+	"mydocker/dns"
+	"mydocker/network"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// networkDetail network inspect 输出的内容，包括网络本身以及连接在该网络上的容器
+type networkDetail struct {
+	Name       string                      `json:"name"`
+	IPRange    string                      `json:"ipRange"`
+	IPv6Range  string                      `json:"ipv6Range,omitempty"`
+	Driver     string                      `json:"driver"`
+	Containers map[string]networkContainer `json:"containers"`
+}
+
+type networkContainer struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+func createNetwork(driver, subnet, ipv6Subnet, name string) error {
+	nw, err := network.CreateNetwork(driver, subnet, ipv6Subnet, name)
+	if err != nil {
+		return errors.WithMessagef(err, "create network %s", name)
+	}
+	// 用户创建的网络启动内置 DNS，容器之间可以通过容器名互相访问
+	if err = startNetworkDNS(nw); err != nil {
+		log.Errorf("Start dns of network %s error %v", nw.Name, err)
+	}
+	fmt.Println(nw.Name)
+	return nil
+}
+
+// startNetworkDNS 在网络的网关地址上启动内置 DNS，默认网络不提供容器名解析
+func startNetworkDNS(nw *network.Network) error {
+	if nw.Name == network.DefaultNetwork {
+		return nil
+	}
+	return dns.Start(nw.Name, net.JoinHostPort(nw.Gateway().String(), strconv.Itoa(dns.DefaultPort)))
+}
+
+func listNetworks() error {
+	networks, err := network.ListNetworks()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	_, _ = fmt.Fprint(w, "NAME\tIpRange\tDriver\n")
+	for _, nw := range networks {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", nw.Name, nw.IPRange.String(), nw.Driver)
+	}
+	if err = w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+	return nil
+}
+
+// removeNetwork 删除网络，还有容器连接在网络上时拒绝删除
+func removeNetwork(name string) error {
+	nw, err := network.LoadNetwork(name)
+	if err != nil {
+		return err
+	}
+	attached, err := getNetworkContainers(nw.Name)
+	if err != nil {
+		return err
+	}
+	if len(attached) > 0 {
+		ids := make([]string, 0, len(attached))
+		for id := range attached {
+			ids = append(ids, id)
+		}
+		return fmt.Errorf("network %s has %d attached container(s) %v, remove them before removing the network",
+			nw.Name, len(ids), ids)
+	}
+	dns.Stop(nw.Name)
+	return network.DeleteNetwork(nw.Name)
+}
+
+func inspectNetwork(name string) error {
+	nw, err := network.LoadNetwork(name)
+	if err != nil {
+		return err
+	}
+	attached, err := getNetworkContainers(nw.Name)
+	if err != nil {
+		return err
+	}
+	detail := &networkDetail{
+		Name:       nw.Name,
+		IPRange:    nw.IPRange.String(),
+		Driver:     nw.Driver,
+		Containers: attached,
+	}
+	if nw.IPv6Range != nil {
+		detail.IPv6Range = nw.IPv6Range.String()
+	}
+	content, err := json.MarshalIndent(detail, "", "    ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal network %s", nw.Name)
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// getNetworkContainers 找到连接在指定网络上的容器，key 为容器 Id
+func getNetworkContainers(networkName string) (map[string]networkContainer, error) {
+	containers, err := getAllContainerInfo()
+	if err != nil {
+		return nil, err
+	}
+	attached := make(map[string]networkContainer)
+	for _, info := range containers {
+		if info.NetworkName == networkName {
+			attached[info.Id] = networkContainer{Name: info.Name, IP: info.IP, IPv6: info.IPv6}
+		}
+	}
+	return attached, nil
+}
+
+// checkCNINetwork 调用 CNI 插件 CHECK 检查 cni 模式容器的网络
+func checkCNINetwork(containerId string) error {
+	containerInfo, pid, err := getRunningContainer(containerId)
+	if err != nil {
+		return err
+	}
+	netMode, netArg := container.ParseNetMode(containerInfo.NetMode)
+	if netMode != container.NetModeCNI {
+		return fmt.Errorf("container %s is not in cni network mode", containerId)
+	}
+	if err = network.CNICheck(netArg, containerInfo.Id, pid, containerInfo.CNIResult); err != nil {
+		return errors.WithMessagef(err, "check cni network %s", netArg)
+	}
+	fmt.Println("ok")
+	return nil
+}
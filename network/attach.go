@@ -0,0 +1,107 @@
+package network
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+)
+
+const (
+	// 热插拔网卡在宿主机一端的名字前缀，完整名字为 att<containerId><n>
+	attachPrefix = "att"
+	// 热插拔网卡移入容器前使用的临时名字前缀
+	attachPeerPrefix = "tmp"
+	// 热插拔网卡在容器内的名字前缀，依次使用 eth1、eth2...
+	attachIfPrefix = "eth"
+)
+
+// AttachedInterface 运行中的容器上热插拔的网卡，会持久化到容器的 config.json 中
+type AttachedInterface struct {
+	Name       string `json:"name"`       // 容器内的网卡名
+	HostVeth   string `json:"hostVeth"`   // 宿主机上 veth 的名字
+	Bridge     string `json:"bridge"`     // 宿主机一端连接的 bridge
+	Address    string `json:"address"`    // 容器内网卡的地址，cidr 格式
+	MacAddress string `json:"macAddress"` // 容器内网卡的 mac 地址
+}
+
+// AttachInterface 为运行中的容器热插拔一块连接到 bridge 的网卡
+/*
+1. bridge 不存在时先创建并启动
+2. 在容器中找到第一个未使用的 ethN 作为网卡名
+3. 创建 veth 对，宿主机一端挂到 bridge 上，另一端移入容器并配置地址
+热插拔的网卡不添加默认路由，只能访问 cidr 所在的网段。
+*/
+func AttachInterface(bridge, containerId string, pid int, cidr string) (*AttachedInterface, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse address %s", cidr)
+	}
+	address := &net.IPNet{IP: ip, Mask: ipNet.Mask}
+
+	exist, err := LinkExists(bridge)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		log.Infof("bridge %s not found, create it", bridge)
+		if err = CreateBridge(bridge); err != nil {
+			return nil, err
+		}
+		if err = SetLinkUp(bridge); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := nextAttachIndex(pid)
+	if err != nil {
+		return nil, err
+	}
+	iface := &AttachedInterface{
+		Name:     fmt.Sprintf("%s%d", attachIfPrefix, n),
+		HostVeth: fmt.Sprintf("%s%s%d", attachPrefix, containerId, n),
+		Bridge:   bridge,
+		Address:  address.String(),
+	}
+	peerName := fmt.Sprintf("%s%s%d", attachPeerPrefix, containerId, n)
+	if err = CreateVethPair(iface.HostVeth, peerName, bridge); err != nil {
+		return nil, err
+	}
+	mac, err := configContainerLink(pid, peerName, iface.Name, iface.Address, nil)
+	if err != nil {
+		// 删除宿主机一端时 veth 对会被一起删除
+		_ = DeleteLink(iface.HostVeth)
+		return nil, err
+	}
+	iface.MacAddress = mac.String()
+	return iface, nil
+}
+
+// DetachInterface 删除热插拔的网卡，删除宿主机一端后容器内的一端也会被内核删除
+func DetachInterface(iface *AttachedInterface) error {
+	return DeleteLink(iface.HostVeth)
+}
+
+// nextAttachIndex 返回容器中第一个未被使用的 ethN 的 N，eth0 保留给容器的主网卡
+func nextAttachIndex(pid int) (int, error) {
+	exit, err := enterContainerNetNS(pid)
+	if err != nil {
+		return 0, err
+	}
+	defer exit()
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, errors.Wrap(err, "list links in container")
+	}
+	used := make(map[string]bool, len(links))
+	for _, link := range links {
+		used[link.Attrs().Name] = true
+	}
+	for n := 1; ; n++ {
+		if !used[fmt.Sprintf("%s%d", attachIfPrefix, n)] {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"github.com/vishvananda/netlink"
+	"testing"
+)
+
+func TestAttachInterface(t *testing.T) {
+	withTempNetNS(t, func() {
+		cmd := startContainerProcess(t)
+		defer stopContainerProcess(cmd)
+		pid := cmd.Process.Pid
+
+		first, err := AttachInterface("br0", "1234567890", pid, "10.1.0.5/24")
+		if err != nil {
+			t.Fatalf("attach %v", err)
+		}
+		second, err := AttachInterface("br0", "1234567890", pid, "10.2.0.5/24")
+		if err != nil {
+			t.Fatalf("attach %v", err)
+		}
+		if first.Name != "eth1" || second.Name != "eth2" {
+			t.Fatalf("unexpected interface names %s %s", first.Name, second.Name)
+		}
+		host, err := netlink.LinkByName(first.HostVeth)
+		if err != nil {
+			t.Fatalf("get host veth %v", err)
+		}
+		br, _ := netlink.LinkByName("br0")
+		if host.Attrs().MasterIndex != br.Attrs().Index {
+			t.Fatalf("host veth %s not attached to br0", first.HostVeth)
+		}
+
+		if err = DetachInterface(first); err != nil {
+			t.Fatalf("detach %v", err)
+		}
+		exit, err := enterContainerNetNS(pid)
+		if err != nil {
+			t.Fatalf("enter container netns %v", err)
+		}
+		defer exit()
+		if exist, _ := LinkExists("eth1"); exist {
+			t.Fatalf("eth1 should be removed")
+		}
+		link, err := netlink.LinkByName("eth2")
+		if err != nil {
+			t.Fatalf("get eth2 %v", err)
+		}
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+		if len(addrs) != 1 || addrs[0].IPNet.String() != "10.2.0.5/24" {
+			t.Fatalf("unexpected addrs %v", addrs)
+		}
+	})
+}
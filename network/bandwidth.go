@@ -0,0 +1,178 @@
+package network
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// tbf 队列中数据包允许等待的最长时间，超过后丢弃，单位毫秒
+	tbfLatencyMs = 25
+	// 令牌桶的最小容量，需要大于网卡 MTU，否则大包永远无法发送
+	minBurstBytes = 32 * 1024
+)
+
+// rateUnits tc 风格的速率单位，bit 结尾的单位为 bit/s，bps 结尾的单位为 byte/s
+var rateUnits = []struct {
+	suffix string
+	bits   uint64
+}{
+	{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+}
+
+// ParseRate 解析 tc 风格的速率，例如 10mbit、512kbit、1mbps，返回 bit/s，空字符串或 0 表示不限制
+func ParseRate(rate string) (uint64, error) {
+	number := strings.ToLower(strings.TrimSpace(rate))
+	if number == "" {
+		return 0, nil
+	}
+	multiplier := uint64(1)
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSuffix(number, unit.suffix)
+			multiplier = unit.bits
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %s", rate)
+	}
+	bits := uint64(value * float64(multiplier))
+	// police 和 tbf 的速率都使用 32 位的 byte/s 表示
+	if bits/8 > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("rate %s too large", rate)
+	}
+	return bits, nil
+}
+
+// SetBandwidth 限制容器 Net Namespace 中除 lo 以外所有网卡的带宽，单位 bit/s，为 0 时删除对应方向的限制
+/*
+- egress(容器发出的流量): 网卡的根队列替换为 tbf，等价于 tc qdisc replace dev eth0 root tbf rate ...
+- ingress(容器收到的流量): 添加 ingress 队列，并通过 u32 匹配所有数据包，超过速率的直接丢弃，
+  等价于 tc qdisc add dev eth0 ingress && tc filter add dev eth0 parent ffff: u32 match u32 0 0 police rate ... drop
+*/
+func SetBandwidth(pid int, egress, ingress uint64) error {
+	exit, err := enterContainerNetNS(pid)
+	if err != nil {
+		return err
+	}
+	defer exit()
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return errors.Wrap(err, "list links in container")
+	}
+	for _, link := range links {
+		if link.Attrs().Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if err = setEgressBandwidth(link, egress); err != nil {
+			return err
+		}
+		if err = setIngressBandwidth(link, ingress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setEgressBandwidth(link netlink.Link, rate uint64) error {
+	name := link.Attrs().Name
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	}
+	if rate == 0 {
+		if err := deleteQdisc(link, "tbf"); err != nil {
+			return errors.Wrapf(err, "delete tbf qdisc of %s", name)
+		}
+		return nil
+	}
+	rateBytes := rate / 8
+	burst := burstBytes(rateBytes)
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: attrs,
+		Rate:       rateBytes,
+		Buffer:     netlink.Xmittime(rateBytes, burst),
+		Limit:      uint32(rateBytes*tbfLatencyMs/1000) + burst,
+	}
+	if err := netlink.QdiscReplace(qdisc); err != nil {
+		return errors.Wrapf(err, "replace tbf qdisc of %s", name)
+	}
+	return nil
+}
+
+func setIngressBandwidth(link netlink.Link, rate uint64) error {
+	name := link.Attrs().Name
+	// ingress 队列上的 filter 无法原地修改，每次都先删除整个 ingress 队列再重新创建
+	if err := deleteQdisc(link, "ingress"); err != nil {
+		return errors.Wrapf(err, "delete ingress qdisc of %s", name)
+	}
+	if rate == 0 {
+		return nil
+	}
+	qdisc := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return errors.Wrapf(err, "add ingress qdisc of %s", name)
+	}
+	rateBytes := rate / 8
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(rateBytes)
+	police.Burst = burstBytes(rateBytes)
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    qdisc.Handle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Sel: &netlink.TcU32Sel{
+			Keys:  []netlink.TcU32Key{{Mask: 0, Val: 0}},
+			Flags: netlink.TC_U32_TERMINAL,
+		},
+		Actions: []netlink.Action{police},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		_ = netlink.QdiscDel(qdisc)
+		return errors.Wrapf(err, "add police filter of %s", name)
+	}
+	return nil
+}
+
+// deleteQdisc 删除网卡上指定类型的队列，不存在时直接返回
+func deleteQdisc(link netlink.Link, qdiscType string) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == qdiscType {
+			return netlink.QdiscDel(qdisc)
+		}
+	}
+	return nil
+}
+
+// burstBytes 令牌桶容量取 100ms 可以发送的数据量，并且不小于 minBurstBytes
+func burstBytes(rateBytes uint64) uint32 {
+	burst := rateBytes / 10
+	if burst < minBurstBytes {
+		burst = minBurstBytes
+	}
+	return uint32(burst)
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"github.com/vishvananda/netlink"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]uint64{
+		"":        0,
+		"0":       0,
+		"10mbit":  10000000,
+		"512Kbit": 512000,
+		"1mbps":   8000000,
+		"1.5gbit": 1500000000,
+		"800":     800,
+	}
+	for rate, expect := range cases {
+		bits, err := ParseRate(rate)
+		if err != nil {
+			t.Fatalf("parse %s %v", rate, err)
+		}
+		if bits != expect {
+			t.Fatalf("parse %s expect %d got %d", rate, expect, bits)
+		}
+	}
+	for _, rate := range []string{"mbit", "-1mbit", "10xbit", "100tbit"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Fatalf("parse %s should fail", rate)
+		}
+	}
+}
+
+func TestSetBandwidth(t *testing.T) {
+	withTempNetNS(t, func() {
+		cmd := startContainerProcess(t)
+		defer stopContainerProcess(cmd)
+		pid := cmd.Process.Pid
+		if _, err := AttachInterface("br0", "1234567890", pid, "10.1.0.5/24"); err != nil {
+			t.Fatalf("attach %v", err)
+		}
+
+		if err := SetBandwidth(pid, 10000000, 0); err != nil {
+			t.Fatalf("set bandwidth %v", err)
+		}
+		// 更新时替换原有的限制
+		if err := SetBandwidth(pid, 20000000, 0); err != nil {
+			t.Fatalf("update bandwidth %v", err)
+		}
+		if qdiscTypes := containerQdiscTypes(t, pid, "eth1"); !qdiscTypes["tbf"] {
+			t.Fatalf("expect tbf qdisc, got %v", qdiscTypes)
+		}
+		if err := SetBandwidth(pid, 0, 0); err != nil {
+			t.Fatalf("clear bandwidth %v", err)
+		}
+		if qdiscTypes := containerQdiscTypes(t, pid, "eth1"); qdiscTypes["tbf"] {
+			t.Fatalf("expect no tbf qdisc, got %v", qdiscTypes)
+		}
+
+		if err := SetBandwidth(pid, 0, 1000000); err != nil {
+			// ingress 限速依赖内核的 act_police 模块
+			t.Skipf("ingress police not supported by kernel: %v", err)
+		}
+		if qdiscTypes := containerQdiscTypes(t, pid, "eth1"); !qdiscTypes["ingress"] {
+			t.Fatalf("expect ingress qdisc, got %v", qdiscTypes)
+		}
+		if err := SetBandwidth(pid, 0, 0); err != nil {
+			t.Fatalf("clear bandwidth %v", err)
+		}
+		if qdiscTypes := containerQdiscTypes(t, pid, "eth1"); qdiscTypes["ingress"] {
+			t.Fatalf("expect no ingress qdisc, got %v", qdiscTypes)
+		}
+	})
+}
+
+func containerQdiscTypes(t *testing.T, pid int, ifName string) map[string]bool {
+	exit, err := enterContainerNetNS(pid)
+	if err != nil {
+		t.Fatalf("enter container netns %v", err)
+	}
+	defer exit()
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		t.Fatalf("get %s %v", ifName, err)
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		t.Fatalf("list qdisc %v", err)
+	}
+	types := make(map[string]bool)
+	for _, qdisc := range qdiscs {
+		types[qdisc.Type()] = true
+	}
+	return types
+}
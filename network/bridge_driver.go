@@ -0,0 +1,111 @@
+package network
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"mydocker/constant"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+type BridgeNetworkDriver struct {
+}
+
+func (d *BridgeNetworkDriver) Name() string {
+	return "bridge"
+}
+
+// Create 创建 bridge 网络
+/*
+1. 创建 Bridge 虚拟设备
+2. 设置 Bridge 设备地址和路由，网段第一个地址作为网关
+3. 启动 Bridge 设备
+4. 设置 iptables SNAT 规则，让容器可以访问外网
+*/
+func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, error) {
+	_, ipRange, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse subnet %s", subnet)
+	}
+	n := &Network{
+		Name:    name,
+		IPRange: ipRange,
+		Driver:  d.Name(),
+	}
+	if err = d.initBridge(n); err != nil {
+		return nil, errors.Wrapf(err, "init bridge %s", name)
+	}
+	return n, nil
+}
+
+// Delete 删除 bridge 网络，同时清理对应的 iptables 规则
+func (d *BridgeNetworkDriver) Delete(network *Network) error {
+	if err := deleteIPTables(network.Name, network.IPRange); err != nil {
+		log.Errorf("delete iptables of bridge %s error %v", network.Name, err)
+	}
+	return DeleteLink(network.Name)
+}
+
+// Connect 创建 veth 设备对，将宿主机一端挂载到 bridge 上
+func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	return CreateVethPair(endpoint.Device, endpoint.PeerName, network.Name)
+}
+
+// Disconnect 删除宿主机上的 veth，veth 是成对存在的，删除一端另一端也会被删除
+// 容器退出后 Net Namespace 销毁时 veth 也会被内核自动删除，因此这里找不到设备时直接忽略
+func (d *BridgeNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	return DeleteLink(endpoint.Device)
+}
+
+func (d *BridgeNetworkDriver) initBridge(n *Network) error {
+	bridgeName := n.Name
+	// 1. 创建 bridge，已存在时直接复用
+	if err := CreateBridge(bridgeName); err != nil {
+		return err
+	}
+	// 2. 设置 bridge 的地址，网关地址 + 网段掩码，例如 172.18.0.1/16
+	gwIP := &net.IPNet{IP: gatewayIP(n.IPRange), Mask: n.IPRange.Mask}
+	if err := SetLinkAddr(bridgeName, gwIP.String()); err != nil {
+		return err
+	}
+	// 3. 启动 bridge
+	if err := SetLinkUp(bridgeName); err != nil {
+		return err
+	}
+	// 4. 开启转发并设置 SNAT
+	if err := os.WriteFile(ipForwardPath, []byte("1"), constant.Perm0644); err != nil {
+		log.Errorf("enable ip_forward error %v", err)
+	}
+	// SNAT 只影响容器访问外网，设置失败时不影响 bridge 内部通信
+	if err := setupIPTables(bridgeName, n.IPRange); err != nil {
+		log.Errorf("set iptables of bridge %s error %v", bridgeName, err)
+	}
+	return nil
+}
+
+// setupIPTables 设置 MASQUERADE 规则，从该网段出去且不是发往 bridge 的包都做源地址转换
+// iptables -t nat -A POSTROUTING -s 172.18.0.0/16 ! -o mydocker0 -j MASQUERADE
+func setupIPTables(bridgeName string, subnet *net.IPNet) error {
+	// bridge 重建时规则可能已经存在，先用 -C 检查，避免重复添加
+	if iptables("-t", "nat", "-C", "POSTROUTING", "-s", subnet.String(), "!", "-o", bridgeName, "-j", "MASQUERADE") == nil {
+		return nil
+	}
+	return iptables("-t", "nat", "-A", "POSTROUTING", "-s", subnet.String(), "!", "-o", bridgeName, "-j", "MASQUERADE")
+}
+
+func deleteIPTables(bridgeName string, subnet *net.IPNet) error {
+	return iptables("-t", "nat", "-D", "POSTROUTING", "-s", subnet.String(), "!", "-o", bridgeName, "-j", "MASQUERADE")
+}
+
+func iptables(args ...string) error {
+	output, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %v, output: %s", strings.Join(args, " "), err, output)
+	}
+	return nil
+}
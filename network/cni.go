@@ -0,0 +1,234 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CNI = "cni"
+	// CNI 协议规定的操作
+	cniCommandAdd   = "ADD"
+	cniCommandDel   = "DEL"
+	cniCommandCheck = "CHECK"
+)
+
+var (
+	// cniConfDir CNI 网络配置所在目录，支持 .conf、.json 格式的单个插件配置和 .conflist 格式的插件链配置
+	cniConfDir = "/etc/mydocker/cni/"
+	// cniBinDirs 查找 CNI 插件可执行文件的目录，可以通过 CNI_PATH 环境变量覆盖，多个目录用 : 分隔
+	cniBinDirs = []string{"/opt/cni/bin"}
+)
+
+func init() {
+	if cniPath := os.Getenv("CNI_PATH"); cniPath != "" {
+		cniBinDirs = filepath.SplitList(cniPath)
+	}
+}
+
+// cniNetworkConfig CNI 网络配置，单个插件的配置也会被转换为只有一个插件的插件链
+type cniNetworkConfig struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// cniError 插件执行失败时输出到 stdout 的错误信息
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details"`
+}
+
+// cniResult 插件 ADD 操作的结果，这里只关心分配给容器的地址
+type cniResult struct {
+	IPs []struct {
+		Address string `json:"address"`
+		Gateway string `json:"gateway"`
+	} `json:"ips"`
+}
+
+// CNIAdd 调用 CNI 网络 networkName 的插件链，将容器加入网络，返回最后一个插件的结果
+/*
+插件按配置中的顺序依次执行 ADD，前一个插件的结果作为 prevResult 传给下一个插件，
+插件通过 CNI_NETNS 环境变量拿到容器的 Net Namespace 路径，即 /proc/<pid>/ns/net。
+*/
+func CNIAdd(networkName, containerId string, pid int) (json.RawMessage, error) {
+	conf, err := loadCNIConfig(networkName)
+	if err != nil {
+		return nil, err
+	}
+	var result json.RawMessage
+	for _, plugin := range conf.Plugins {
+		if result, err = execCNIPlugin(cniCommandAdd, conf, plugin, result, containerId, cniNetNS(pid)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// CNIDel 调用 CNI 网络 networkName 的插件链，将容器从网络中删除，插件按照和 ADD 相反的顺序执行
+// 容器已经退出时 pid 传 0，此时 CNI_NETNS 为空，插件只需要释放 IP 等宿主机上的资源
+func CNIDel(networkName, containerId string, pid int, prevResult json.RawMessage) error {
+	conf, err := loadCNIConfig(networkName)
+	if err != nil {
+		return err
+	}
+	for i := len(conf.Plugins) - 1; i >= 0; i-- {
+		if _, err = execCNIPlugin(cniCommandDel, conf, conf.Plugins[i], prevResult, containerId, cniNetNS(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CNICheck 调用 CNI 网络 networkName 的插件链检查容器的网络是否和 ADD 的结果一致
+func CNICheck(networkName, containerId string, pid int, prevResult json.RawMessage) error {
+	conf, err := loadCNIConfig(networkName)
+	if err != nil {
+		return err
+	}
+	for _, plugin := range conf.Plugins {
+		if _, err = execCNIPlugin(cniCommandCheck, conf, plugin, prevResult, containerId, cniNetNS(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CNIResultIP 返回 CNI 结果中容器的第一个 IP，没有时返回空字符串
+func CNIResultIP(result json.RawMessage) string {
+	var res cniResult
+	if err := json.Unmarshal(result, &res); err != nil || len(res.IPs) == 0 {
+		return ""
+	}
+	ip, _, err := net.ParseCIDR(res.IPs[0].Address)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func cniNetNS(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+// loadCNIConfig 在 cniConfDir 中查找 name 字段为 networkName 的网络配置
+func loadCNIConfig(networkName string) (*cniNetworkConfig, error) {
+	files, err := os.ReadDir(cniConfDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read cni config dir %s", cniConfDir)
+	}
+	for _, file := range files {
+		ext := path.Ext(file.Name())
+		if file.IsDir() || (ext != ".conf" && ext != ".json" && ext != ".conflist") {
+			continue
+		}
+		confPath := path.Join(cniConfDir, file.Name())
+		data, err := os.ReadFile(confPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read cni config %s", confPath)
+		}
+		conf := &cniNetworkConfig{}
+		if ext == ".conflist" {
+			err = json.Unmarshal(data, conf)
+		} else {
+			var plugin map[string]interface{}
+			if err = json.Unmarshal(data, &plugin); err == nil {
+				conf.CNIVersion, _ = plugin["cniVersion"].(string)
+				conf.Name, _ = plugin["name"].(string)
+				conf.Plugins = []map[string]interface{}{plugin}
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse cni config %s", confPath)
+		}
+		if conf.Name != networkName {
+			continue
+		}
+		if len(conf.Plugins) == 0 {
+			return nil, fmt.Errorf("cni network %s has no plugins", networkName)
+		}
+		return conf, nil
+	}
+	return nil, fmt.Errorf("cni network %s not found in %s", networkName, cniConfDir)
+}
+
+// execCNIPlugin 执行插件的一次操作，配置通过 stdin 传入，参数通过 CNI_* 环境变量传入，结果从 stdout 读取
+func execCNIPlugin(command string, conf *cniNetworkConfig, plugin map[string]interface{}, prevResult json.RawMessage,
+	containerId, netns string) (json.RawMessage, error) {
+	pluginType, _ := plugin["type"].(string)
+	if pluginType == "" {
+		return nil, fmt.Errorf("cni network %s has plugin without type", conf.Name)
+	}
+	pluginPath, err := findCNIPlugin(pluginType)
+	if err != nil {
+		return nil, err
+	}
+
+	// 插件链中的插件使用网络的 name 和 cniVersion
+	stdin := make(map[string]interface{}, len(plugin)+3)
+	for k, v := range plugin {
+		stdin[k] = v
+	}
+	stdin["name"] = conf.Name
+	stdin["cniVersion"] = conf.CNIVersion
+	if len(prevResult) > 0 {
+		stdin["prevResult"] = prevResult
+	}
+	stdinBytes, err := json.Marshal(stdin)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal config of cni plugin %s", pluginType)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(pluginPath)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+containerId,
+		"CNI_NETNS="+netns,
+		"CNI_IFNAME="+ContainerIfName,
+		"CNI_PATH="+strings.Join(cniBinDirs, string(os.PathListSeparator)),
+	)
+	cmd.Stdin = bytes.NewReader(stdinBytes)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		var pluginErr cniError
+		if json.Unmarshal(stdout.Bytes(), &pluginErr) == nil && pluginErr.Msg != "" {
+			return nil, fmt.Errorf("cni plugin %s %s failed: %s (code %d) %s", pluginType, command, pluginErr.Msg,
+				pluginErr.Code, pluginErr.Details)
+		}
+		return nil, errors.Wrapf(err, "cni plugin %s %s failed: %s", pluginType, command, stderr.String())
+	}
+	// 只有 ADD 操作有结果输出
+	if command != cniCommandAdd {
+		return nil, nil
+	}
+	if !json.Valid(stdout.Bytes()) {
+		return nil, fmt.Errorf("cni plugin %s %s returned invalid result %s", pluginType, command, stdout.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// findCNIPlugin 在 cniBinDirs 中查找插件的可执行文件
+func findCNIPlugin(pluginType string) (string, error) {
+	for _, dir := range cniBinDirs {
+		pluginPath := path.Join(dir, pluginType)
+		if info, err := os.Stat(pluginPath); err == nil && !info.IsDir() {
+			return pluginPath, nil
+		}
+	}
+	return "", fmt.Errorf("cni plugin %s not found in %s", pluginType, strings.Join(cniBinDirs, ":"))
+}
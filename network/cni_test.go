@@ -0,0 +1,107 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// setupCNI 编译测试用的 stub 插件，并将配置目录和插件目录指向临时目录
+func setupCNI(t *testing.T) (confDir, logFile string) {
+	binDir := t.TempDir()
+	confDir = t.TempDir()
+	out, err := exec.Command("go", "build", "-o", path.Join(binDir, "stub"), "./testdata/cni-stub").CombinedOutput()
+	if err != nil {
+		t.Skipf("build cni stub plugin %v: %s", err, out)
+	}
+	originConfDir, originBinDirs := cniConfDir, cniBinDirs
+	cniConfDir, cniBinDirs = confDir, []string{binDir}
+	t.Cleanup(func() {
+		cniConfDir, cniBinDirs = originConfDir, originBinDirs
+	})
+	return confDir, path.Join(confDir, "calls.log")
+}
+
+func writeCNIConfig(t *testing.T, confPath, content string) {
+	if err := os.WriteFile(confPath, []byte(content), 0644); err != nil {
+		t.Fatalf("write cni config %v", err)
+	}
+}
+
+func readCNICalls(t *testing.T, logFile string) []string {
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("read cni calls %v", err)
+	}
+	_ = os.Remove(logFile)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestCNIPluginChain(t *testing.T) {
+	confDir, logFile := setupCNI(t)
+	writeCNIConfig(t, path.Join(confDir, "10-chain.conflist"), fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "chain",
+  "plugins": [
+    {"type": "stub", "address": "10.22.0.5/24", "logFile": %q},
+    {"type": "stub", "address": "second", "logFile": %q}
+  ]
+}`, logFile, logFile))
+
+	pid := os.Getpid()
+	netns := fmt.Sprintf("/proc/%d/ns/net", pid)
+	result, err := CNIAdd("chain", "1234567890", pid)
+	if err != nil {
+		t.Fatalf("cni add %v", err)
+	}
+	if ip := CNIResultIP(result); ip != "10.22.0.5" {
+		t.Fatalf("expect ip 10.22.0.5, got %s from %s", ip, result)
+	}
+	calls := readCNICalls(t, logFile)
+	expect := []string{
+		"ADD 10.22.0.5/24 1234567890 " + netns + " eth0 false",
+		"ADD second 1234567890 " + netns + " eth0 true",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("unexpected add calls %v", calls)
+	}
+
+	if err = CNICheck("chain", "1234567890", pid, result); err != nil {
+		t.Fatalf("cni check %v", err)
+	}
+	_ = readCNICalls(t, logFile)
+
+	// 容器退出后删除时 CNI_NETNS 为空，插件按相反的顺序执行
+	if err = CNIDel("chain", "1234567890", 0, result); err != nil {
+		t.Fatalf("cni del %v", err)
+	}
+	calls = readCNICalls(t, logFile)
+	expect = []string{
+		"DEL second 1234567890  eth0 true",
+		"DEL 10.22.0.5/24 1234567890  eth0 true",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("unexpected del calls %v", calls)
+	}
+}
+
+func TestCNIPluginError(t *testing.T) {
+	confDir, _ := setupCNI(t)
+	writeCNIConfig(t, path.Join(confDir, "fail.conf"),
+		`{"cniVersion": "1.0.0", "name": "fail", "type": "stub", "fail": true}`)
+	writeCNIConfig(t, path.Join(confDir, "missing.conf"),
+		`{"cniVersion": "1.0.0", "name": "missing", "type": "not-exist"}`)
+
+	if _, err := CNIAdd("fail", "1234567890", os.Getpid()); err == nil || !strings.Contains(err.Error(), "stub failure") {
+		t.Fatalf("expect stub failure, got %v", err)
+	}
+	if _, err := CNIAdd("missing", "1234567890", os.Getpid()); err == nil {
+		t.Fatalf("expect plugin not found error")
+	}
+	if _, err := CNIAdd("unknown", "1234567890", os.Getpid()); err == nil {
+		t.Fatalf("expect network not found error")
+	}
+}
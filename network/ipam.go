@@ -0,0 +1,229 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"mydocker/constant"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	ipamDefaultAllocatorPath = "/var/lib/mydocker/network/ipam/subnet.json"
+	// IPv6 网段通常很大(例如 /64)，位图只记录网段中前 2^16 个地址的分配情况
+	maxBitmapBits = 16
+)
+
+var ErrNoAvailableIP = errors.New("no available ip in subnet")
+
+// IPAM 存放 IP 地址分配信息
+/*
+每个网段用一个位图记录地址分配情况，位图以字符串形式存储，第 n 位为 1 表示网段中的第 n 个地址已被分配。
+为了避免多个 mydocker 进程同时分配 IP 导致冲突，每次读写分配文件前都会对锁文件加 flock 排他锁。
+*/
+type IPAM struct {
+	// 分配文件存放位置
+	SubnetAllocatorPath string
+	// 网段和位图的 map，key 是网段，value 是分配的位图
+	Subnets map[string]string
+}
+
+// 初始化一个 IPAM 对象，默认使用 /var/lib/mydocker/network/ipam/subnet.json 作为分配信息存储位置
+var ipAllocator = &IPAM{
+	SubnetAllocatorPath: ipamDefaultAllocatorPath,
+}
+
+// Allocate 在网段中分配一个可用的 IP 地址
+func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
+	err = ipam.withLock(func() error {
+		bitmap, err := ipam.bitmap(subnet)
+		if err != nil {
+			return err
+		}
+		idx := strings.IndexByte(bitmap, '0')
+		if idx < 0 {
+			return errors.Wrapf(ErrNoAvailableIP, "subnet %s", subnet.String())
+		}
+		if ipam.Subnets[subnet.String()], err = setBit(bitmap, idx, '1'); err != nil {
+			return err
+		}
+		ip = nthIP(subnet, idx)
+		return nil
+	})
+	return ip, err
+}
+
+// Release 释放一个 IP 地址，地址不在网段中时报错
+func (ipam *IPAM) Release(subnet *net.IPNet, ipaddr net.IP) error {
+	return ipam.withLock(func() error {
+		idx, err := ipIndex(subnet, ipaddr)
+		if err != nil {
+			return err
+		}
+		bitmap, err := ipam.bitmap(subnet)
+		if err != nil {
+			return err
+		}
+		// 网络号和 IPv4 的广播地址不能释放
+		if idx == 0 || (subnet.IP.To4() != nil && idx == len(bitmap)-1) {
+			return fmt.Errorf("ip %s is reserved in subnet %s", ipaddr.String(), subnet.String())
+		}
+		ipam.Subnets[subnet.String()], err = setBit(bitmap, idx, '0')
+		return err
+	})
+}
+
+// ReserveGateway 将网段中的第一个地址保留为网关，重复调用时返回同一个地址
+func (ipam *IPAM) ReserveGateway(subnet *net.IPNet) (gateway net.IP, err error) {
+	err = ipam.withLock(func() error {
+		bitmap, err := ipam.bitmap(subnet)
+		if err != nil {
+			return err
+		}
+		if ipam.Subnets[subnet.String()], err = setBit(bitmap, 1, '1'); err != nil {
+			return err
+		}
+		gateway = nthIP(subnet, 1)
+		return nil
+	})
+	return gateway, err
+}
+
+// Delete 删除网段的分配信息，网络删除时调用
+func (ipam *IPAM) Delete(subnet *net.IPNet) error {
+	return ipam.withLock(func() error {
+		delete(ipam.Subnets, subnet.String())
+		return nil
+	})
+}
+
+// bitmap 返回网段的位图，网段第一次出现时初始化位图，并保留网络号和 IPv4 的广播地址
+// 去掉保留地址后没有可用地址的网段(例如 IPv4 的 /31、/32)返回错误
+func (ipam *IPAM) bitmap(subnet *net.IPNet) (string, error) {
+	if bitmap, exist := ipam.Subnets[subnet.String()]; exist {
+		return bitmap, nil
+	}
+	ones, bits := subnet.Mask.Size()
+	isIPv6 := subnet.IP.To4() == nil
+	if isIPv6 && bits-ones > maxBitmapBits {
+		ones = bits - maxBitmapBits
+	}
+	size := 1 << uint(bits-ones)
+	// 网络号之外，IPv4 还要保留广播地址，IPv6 没有广播地址
+	reserved := 2
+	if isIPv6 {
+		reserved = 1
+	}
+	if size <= reserved {
+		return "", fmt.Errorf("subnet %s has no usable address", subnet.String())
+	}
+	bitmap := []byte(strings.Repeat("0", size))
+	bitmap[0] = '1'
+	if !isIPv6 {
+		bitmap[size-1] = '1'
+	}
+	ipam.Subnets[subnet.String()] = string(bitmap)
+	return string(bitmap), nil
+}
+
+// withLock 持有文件锁，从文件加载分配信息，执行 fn 后再写回文件
+func (ipam *IPAM) withLock(fn func() error) error {
+	dir, _ := path.Split(ipam.SubnetAllocatorPath)
+	if err := os.MkdirAll(dir, constant.Perm0755); err != nil {
+		return errors.Wrapf(err, "mkdir %s", dir)
+	}
+	lockFile, err := os.OpenFile(ipam.SubnetAllocatorPath+".lock", os.O_CREATE|os.O_RDWR, constant.Perm0644)
+	if err != nil {
+		return errors.Wrap(err, "open ipam lock file")
+	}
+	defer lockFile.Close()
+	if err = unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return errors.Wrap(err, "lock ipam")
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	if err = ipam.load(); err != nil {
+		return err
+	}
+	if err = fn(); err != nil {
+		return err
+	}
+	return ipam.dump()
+}
+
+// load 加载网段地址分配信息
+func (ipam *IPAM) load() error {
+	ipam.Subnets = map[string]string{}
+	subnetJson, err := os.ReadFile(ipam.SubnetAllocatorPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "read %s", ipam.SubnetAllocatorPath)
+	}
+	if len(subnetJson) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(subnetJson, &ipam.Subnets); err != nil {
+		return errors.Wrap(err, "unmarshal ipam")
+	}
+	return nil
+}
+
+// dump 存储网段地址分配信息，先写临时文件再 rename，避免写到一半时文件损坏
+func (ipam *IPAM) dump() error {
+	ipamJson, err := json.Marshal(ipam.Subnets)
+	if err != nil {
+		return errors.Wrap(err, "marshal ipam")
+	}
+	tmpPath := ipam.SubnetAllocatorPath + ".tmp"
+	if err = os.WriteFile(tmpPath, ipamJson, constant.Perm0644); err != nil {
+		return errors.Wrapf(err, "write %s", tmpPath)
+	}
+	return os.Rename(tmpPath, ipam.SubnetAllocatorPath)
+}
+
+// setBit 将位图的第 idx 位设置为 v，idx 超出位图范围时返回错误
+func setBit(bitmap string, idx int, v byte) (string, error) {
+	if idx < 0 || idx >= len(bitmap) {
+		return "", fmt.Errorf("index %d out of bitmap range %d", idx, len(bitmap))
+	}
+	b := []byte(bitmap)
+	b[idx] = v
+	return string(b), nil
+}
+
+// nthIP 网段中第 n 个地址
+func nthIP(subnet *net.IPNet, n int) net.IP {
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip4)+uint32(n))
+		return ip
+	}
+	// IPv6 地址把后 8 个字节当作整数相加，n 不会超过位图大小，因此不会溢出到前 8 个字节
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, subnet.IP.To16())
+	binary.BigEndian.PutUint64(ip[8:], binary.BigEndian.Uint64(ip[8:])+uint64(n))
+	return ip
+}
+
+// ipIndex 地址在网段中的序号，IPv6 地址需要在位图记录的范围内
+func ipIndex(subnet *net.IPNet, ip net.IP) (int, error) {
+	if !subnet.Contains(ip) {
+		return 0, fmt.Errorf("ip %s not in subnet %s", ip.String(), subnet.String())
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return int(binary.BigEndian.Uint32(ip4) - binary.BigEndian.Uint32(subnet.IP.To4())), nil
+	}
+	ip16, base := ip.To16(), subnet.IP.To16()
+	idx := binary.BigEndian.Uint64(ip16[8:]) - binary.BigEndian.Uint64(base[8:])
+	if !ip16[:8].Equal(base[:8]) || idx >= 1<<maxBitmapBits {
+		return 0, fmt.Errorf("ip %s out of allocation range of subnet %s", ip.String(), subnet.String())
+	}
+	return int(idx), nil
+}
@@ -0,0 +1,150 @@
+package network
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"path"
+	"sync"
+	"testing"
+)
+
+func newTestIPAM(t *testing.T) *IPAM {
+	return &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+}
+
+func TestIPAMAllocateExhaustion(t *testing.T) {
+	ipam := newTestIPAM(t)
+	// /29 共 8 个地址，去掉网络号、广播地址和网关后剩余 5 个
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/29")
+	gateway, err := ipam.ReserveGateway(subnet)
+	if err != nil {
+		t.Fatalf("reserve gateway %v", err)
+	}
+	if gateway.String() != "192.168.0.1" {
+		t.Fatalf("gateway should be 192.168.0.1, got %s", gateway)
+	}
+
+	allocated := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		ip, err := ipam.Allocate(subnet)
+		if err != nil {
+			t.Fatalf("allocate %d %v", i, err)
+		}
+		if allocated[ip.String()] || ip.Equal(gateway) {
+			t.Fatalf("ip %s allocated twice", ip)
+		}
+		allocated[ip.String()] = true
+		t.Logf("alloc ip: %v", ip)
+	}
+	if _, err = ipam.Allocate(subnet); !errors.Is(err, ErrNoAvailableIP) {
+		t.Fatalf("subnet should be exhausted, got %v", err)
+	}
+}
+
+func TestIPAMRelease(t *testing.T) {
+	ipam := newTestIPAM(t)
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/30")
+	// /30 只有 2 个可用地址
+	first, err := ipam.Allocate(subnet)
+	if err != nil {
+		t.Fatalf("allocate %v", err)
+	}
+	if _, err = ipam.Allocate(subnet); err != nil {
+		t.Fatalf("allocate %v", err)
+	}
+	if _, err = ipam.Allocate(subnet); !errors.Is(err, ErrNoAvailableIP) {
+		t.Fatalf("subnet should be exhausted, got %v", err)
+	}
+
+	if err = ipam.Release(subnet, first); err != nil {
+		t.Fatalf("release %v", err)
+	}
+	// 释放后可以重新分配到同一个地址，且分配信息在新的 IPAM 对象中同样可见
+	reloaded := &IPAM{SubnetAllocatorPath: ipam.SubnetAllocatorPath}
+	ip, err := reloaded.Allocate(subnet)
+	if err != nil {
+		t.Fatalf("allocate after release %v", err)
+	}
+	if !ip.Equal(first) {
+		t.Fatalf("expect %s after release, got %s", first, ip)
+	}
+
+	if err = ipam.Release(subnet, net.ParseIP("10.0.0.1")); err == nil {
+		t.Fatalf("release ip out of subnet should fail")
+	}
+}
+
+func TestIPAMConcurrentAllocate(t *testing.T) {
+	allocatorPath := newTestIPAM(t).SubnetAllocatorPath
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/24")
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ips = map[string]bool{}
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// 每个 goroutine 使用独立的 IPAM 对象，模拟多个 mydocker 进程
+			ip, err := (&IPAM{SubnetAllocatorPath: allocatorPath}).Allocate(subnet)
+			if err != nil {
+				t.Errorf("allocate %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ips[ip.String()] {
+				t.Errorf("ip %s allocated twice", ip)
+			}
+			ips[ip.String()] = true
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIPAMIPv6(t *testing.T) {
+	ipam := newTestIPAM(t)
+	_, subnet, _ := net.ParseCIDR("fd00:10::/64")
+	gateway, err := ipam.ReserveGateway(subnet)
+	if err != nil {
+		t.Fatalf("reserve gateway %v", err)
+	}
+	if gateway.String() != "fd00:10::1" {
+		t.Fatalf("gateway should be fd00:10::1, got %s", gateway)
+	}
+	ip, err := ipam.Allocate(subnet)
+	if err != nil {
+		t.Fatalf("allocate %v", err)
+	}
+	if ip.String() != "fd00:10::2" {
+		t.Fatalf("ip should be fd00:10::2, got %s", ip)
+	}
+	if err = ipam.Release(subnet, ip); err != nil {
+		t.Fatalf("release %v", err)
+	}
+	if again, _ := ipam.Allocate(subnet); !again.Equal(ip) {
+		t.Fatalf("released ip %s should be reused, got %s", ip, again)
+	}
+	// 位图只记录网段中前 2^16 个地址
+	if err = ipam.Release(subnet, net.ParseIP("fd00:10::1:0")); err == nil {
+		t.Fatalf("ip out of allocation range should fail")
+	}
+}
+
+func TestIPAMNoUsableAddress(t *testing.T) {
+	ipam := newTestIPAM(t)
+	for _, cidr := range []string{"10.0.0.1/32", "10.0.0.0/31", "fd00:10::/128"} {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		if _, err := ipam.ReserveGateway(subnet); err == nil {
+			t.Fatalf("reserve gateway of %s should fail", cidr)
+		}
+		if _, err := ipam.Allocate(subnet); err == nil {
+			t.Fatalf("allocate in %s should fail", cidr)
+		}
+	}
+	if _, err := setBit("01", 2, '1'); err == nil {
+		t.Fatalf("set bit out of range should fail")
+	}
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"mydocker/constant"
+	"net"
+	"os"
+)
+
+const (
+	ipv6ForwardPath = "/proc/sys/net/ipv6/conf/all/forwarding"
+	// 网卡的 IPv6 开关，路径中的 %s 为网卡名
+	ipv6DisablePathFormat = "/proc/sys/net/ipv6/conf/%s/disable_ipv6"
+)
+
+// ParseIPv6Subnet 解析 IPv6 网段，例如 fd00:10::/64
+func ParseIPv6Subnet(subnet string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse ipv6 subnet %s", subnet)
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an ipv6 subnet", subnet)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > 126 {
+		return nil, fmt.Errorf("ipv6 subnet %s is too small", subnet)
+	}
+	return ipNet, nil
+}
+
+// setupIPv6 为开启了 IPv6 的网络开启宿主机的 IPv6 转发，并在 bridge 上配置 IPv6 网段的第一个地址作为网关
+// 创建网络以及网络设备被重新创建时调用，未开启 IPv6 的网络直接返回
+func setupIPv6(nw *Network) error {
+	if nw.IPv6Range == nil {
+		return nil
+	}
+	if err := writeSysctl(ipv6ForwardPath, "1"); err != nil {
+		return err
+	}
+	if err := writeSysctl(fmt.Sprintf(ipv6DisablePathFormat, nw.Name), "0"); err != nil {
+		return err
+	}
+	ones, _ := nw.IPv6Range.Mask.Size()
+	return SetLinkAddr(nw.Name, fmt.Sprintf("%s/%d", gatewayIP(nw.IPv6Range).String(), ones))
+}
+
+// ConnectIPv6 为已经连接到 bridge 网络的容器配置 IPv6，返回容器的 IPv6 地址，cidr 格式
+/*
+1. 从网络的 IPv6 网段中为容器分配一个地址，网关在创建网络时已经配置到 bridge 上
+2. 在容器的 Net Namespace 中为 eth0 配置地址，并添加经过网关的 IPv6 默认路由
+*/
+func ConnectIPv6(nw *Network, pid int) (string, error) {
+	if nw.IPv6Range == nil {
+		return "", fmt.Errorf("ipv6 is not enabled on network %s, create it with --ipv6-subnet", nw.Name)
+	}
+	ip, err := ipAllocator.Allocate(nw.IPv6Range)
+	if err != nil {
+		return "", err
+	}
+	ones, _ := nw.IPv6Range.Mask.Size()
+	cidr := fmt.Sprintf("%s/%d", ip.String(), ones)
+	if err = configContainerIPv6(pid, cidr, gatewayIP(nw.IPv6Range)); err != nil {
+		_ = ipAllocator.Release(nw.IPv6Range, ip)
+		return "", err
+	}
+	return cidr, nil
+}
+
+// DisconnectIPv6 释放容器的 IPv6 地址，cidr 为 ConnectIPv6 返回的地址
+func DisconnectIPv6(cidr string) error {
+	if cidr == "" {
+		return nil
+	}
+	ip, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return errors.Wrapf(err, "parse ipv6 address %s", cidr)
+	}
+	return ipAllocator.Release(subnet, ip)
+}
+
+func configContainerIPv6(pid int, cidr string, gateway net.IP) error {
+	exit, err := enterContainerNetNS(pid)
+	if err != nil {
+		return err
+	}
+	defer exit()
+
+	// /proc/sys/net 下的内容属于当前线程所在的 Net Namespace
+	if err = writeSysctl(fmt.Sprintf(ipv6DisablePathFormat, ContainerIfName), "0"); err != nil {
+		return err
+	}
+	if err = SetLinkAddr(ContainerIfName, cidr); err != nil {
+		return err
+	}
+	return AddDefaultRoute(ContainerIfName, gateway)
+}
+
+func writeSysctl(sysctlPath, value string) error {
+	if err := os.WriteFile(sysctlPath, []byte(value), constant.Perm0644); err != nil {
+		return errors.Wrapf(err, "write %s to %s", value, sysctlPath)
+	}
+	return nil
+}
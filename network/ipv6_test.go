@@ -0,0 +1,58 @@
+package network
+
+import (
+	"github.com/vishvananda/netlink"
+	"net"
+	"testing"
+)
+
+func TestConfigContainerIPv6(t *testing.T) {
+	withTempNetNS(t, func() {
+		cmd := startContainerProcess(t)
+		defer stopContainerProcess(cmd)
+		pid := cmd.Process.Pid
+
+		if err := CreateVethPair("vethtest", "ciftest", ""); err != nil {
+			t.Fatalf("create veth %v", err)
+		}
+		if _, err := configContainerLink(pid, "ciftest", ContainerIfName, "10.1.0.2/24", nil); err != nil {
+			t.Fatalf("config container link %v", err)
+		}
+		if err := SetLinkAddr("vethtest", "fd00:10::1/64"); err != nil {
+			t.Fatalf("set host addr %v", err)
+		}
+		if err := configContainerIPv6(pid, "fd00:10::2/64", net.ParseIP("fd00:10::1")); err != nil {
+			t.Fatalf("config container ipv6 %v", err)
+		}
+
+		exit, err := enterContainerNetNS(pid)
+		if err != nil {
+			t.Fatalf("enter container netns %v", err)
+		}
+		defer exit()
+		link, err := netlink.LinkByName(ContainerIfName)
+		if err != nil {
+			t.Fatalf("get %s %v", ContainerIfName, err)
+		}
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V6)
+		found := false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == "fd00:10::2/64" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("ipv6 address not found in %v", addrs)
+		}
+		routes, _ := netlink.RouteList(link, netlink.FAMILY_V6)
+		hasDefault := false
+		for _, route := range routes {
+			if route.Gw != nil && route.Gw.String() == "fd00:10::1" {
+				hasDefault = true
+			}
+		}
+		if !hasDefault {
+			t.Fatalf("ipv6 default route not found in %v", routes)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// 基于 netlink 的网卡管理，不依赖 ip 命令，操作的都是当前线程所在 Net Namespace 中的网卡
+
+// SetupLoopback 启动当前 Net Namespace 中的 lo 网卡，新建的 Net Namespace 中 lo 默认是 down 的
+func SetupLoopback() error {
+	return SetLinkUp("lo")
+}
+
+// SetLinkUp 启动网卡，等价于 ip link set <name> up
+func SetLinkUp(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return errors.Wrapf(err, "get link %s", name)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return errors.Wrapf(err, "set link %s up", name)
+	}
+	return nil
+}
+
+// SetLinkAddr 为网卡设置地址，cidr 例如 172.18.0.1/16，等价于 ip addr replace 172.18.0.1/16 dev <name>
+// 由于地址中带了网段，内核会自动添加到该网段的路由
+func SetLinkAddr(name, cidr string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return errors.Wrapf(err, "get link %s", name)
+	}
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return errors.Wrapf(err, "parse addr %s", cidr)
+	}
+	// IPv6 地址跳过重复地址检测(DAD)，否则地址在检测完成前处于 tentative 状态无法使用
+	if addr.IP.To4() == nil {
+		addr.Flags |= unix.IFA_F_NODAD
+	}
+	if err = netlink.AddrReplace(link, addr); err != nil {
+		return errors.Wrapf(err, "add addr %s to %s", cidr, name)
+	}
+	return nil
+}
+
+// LinkExists 判断网卡是否存在
+func LinkExists(name string) (bool, error) {
+	_, err := netlink.LinkByName(name)
+	if err == nil {
+		return true, nil
+	}
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return false, errors.Wrapf(err, "get link %s", name)
+}
+
+// CreateBridge 创建 bridge，已存在时直接返回，等价于 ip link add <name> type bridge
+func CreateBridge(name string) error {
+	exist, err := LinkExists(name)
+	if err != nil || exist {
+		return err
+	}
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	if err = netlink.LinkAdd(&netlink.Bridge{LinkAttrs: la}); err != nil {
+		return errors.Wrapf(err, "create bridge %s", name)
+	}
+	return nil
+}
+
+// CreateVethPair 创建 veth 设备对并启动 name 一端，master 不为空时将 name 一端挂到 master(bridge) 上
+// 等价于 ip link add <name> type veth peer name <peer> && ip link set <name> master <master> up
+func CreateVethPair(name, peerName, master string) error {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	if master != "" {
+		br, err := netlink.LinkByName(master)
+		if err != nil {
+			return errors.Wrapf(err, "get master %s", master)
+		}
+		la.MasterIndex = br.Attrs().Index
+	}
+	veth := &netlink.Veth{LinkAttrs: la, PeerName: peerName}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return errors.Wrapf(err, "add veth %s", name)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return errors.Wrapf(err, "set veth %s up", name)
+	}
+	return nil
+}
+
+// SetLinkNsByPid 将网卡移动到进程 pid 所在的 Net Namespace，等价于 ip link set <name> netns <pid>
+func SetLinkNsByPid(name string, pid int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return errors.Wrapf(err, "get link %s", name)
+	}
+	if err = netlink.LinkSetNsPid(link, pid); err != nil {
+		return errors.Wrapf(err, "move %s into netns of pid %d", name, pid)
+	}
+	return nil
+}
+
+// RenameLink 重命名网卡，网卡需要处于 down 状态
+func RenameLink(name, newName string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return errors.Wrapf(err, "get link %s", name)
+	}
+	if err = netlink.LinkSetName(link, newName); err != nil {
+		return errors.Wrapf(err, "rename %s to %s", name, newName)
+	}
+	return nil
+}
+
+// DeleteLink 删除网卡，网卡不存在时直接返回
+func DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return errors.Wrapf(err, "get link %s", name)
+	}
+	if err = netlink.LinkDel(link); err != nil {
+		return errors.Wrapf(err, "delete link %s", name)
+	}
+	return nil
+}
+
+// AddDefaultRoute 添加经过网卡 name 到网关 gw 的默认路由，等价于 ip route add default via <gw> dev <name>
+func AddDefaultRoute(name string, gw net.IP) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return errors.Wrapf(err, "get link %s", name)
+	}
+	dst := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 8*net.IPv4len)}
+	if gw.To4() == nil {
+		dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: gw, Dst: dst}
+	if err = netlink.RouteAdd(route); err != nil {
+		return errors.Wrapf(err, "add default route via %s dev %s", gw.String(), name)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package network
+
+import (
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// withTempNetNS 在一个临时的 Net Namespace 中执行 fn，执行完后切换回原来的 Namespace
+func withTempNetNS(t *testing.T, fn func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to create net namespace")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get current netns %v", err)
+	}
+	defer origin.Close()
+	// netns.New 会创建新的 Net Namespace 并将当前线程切换过去
+	ns, err := netns.New()
+	if err != nil {
+		t.Fatalf("create netns %v", err)
+	}
+	defer ns.Close()
+	defer func() {
+		if err := netns.Set(origin); err != nil {
+			t.Fatalf("restore netns %v", err)
+		}
+	}()
+	fn()
+}
+
+func linkIsUp(t *testing.T, name string) bool {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatalf("get link %s %v", name, err)
+	}
+	return link.Attrs().Flags&net.FlagUp != 0
+}
+
+func TestSetupLoopback(t *testing.T) {
+	withTempNetNS(t, func() {
+		if linkIsUp(t, "lo") {
+			t.Fatalf("lo should be down in new netns")
+		}
+		if err := SetupLoopback(); err != nil {
+			t.Fatalf("setup loopback %v", err)
+		}
+		if !linkIsUp(t, "lo") {
+			t.Fatalf("lo should be up")
+		}
+	})
+}
+
+func TestBridgeAndVeth(t *testing.T) {
+	withTempNetNS(t, func() {
+		if err := CreateBridge("testbr0"); err != nil {
+			t.Fatalf("create bridge %v", err)
+		}
+		// 重复创建直接复用
+		if err := CreateBridge("testbr0"); err != nil {
+			t.Fatalf("create bridge again %v", err)
+		}
+		if err := SetLinkAddr("testbr0", "10.99.0.1/24"); err != nil {
+			t.Fatalf("set bridge addr %v", err)
+		}
+		if err := SetLinkUp("testbr0"); err != nil {
+			t.Fatalf("set bridge up %v", err)
+		}
+		if err := CreateVethPair("testveth0", "testpeer0", "testbr0"); err != nil {
+			t.Fatalf("create veth %v", err)
+		}
+		br, _ := netlink.LinkByName("testbr0")
+		veth, _ := netlink.LinkByName("testveth0")
+		if veth.Attrs().MasterIndex != br.Attrs().Index {
+			t.Fatalf("veth should be attached to bridge")
+		}
+		if !linkIsUp(t, "testveth0") {
+			t.Fatalf("veth should be up")
+		}
+		addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+		if err != nil || len(addrs) != 1 || addrs[0].IPNet.String() != "10.99.0.1/24" {
+			t.Fatalf("unexpected bridge addr %v %v", addrs, err)
+		}
+
+		if err = RenameLink("testpeer0", "eth0"); err != nil {
+			t.Fatalf("rename peer %v", err)
+		}
+		if err = SetLinkAddr("eth0", "10.99.0.2/24"); err != nil {
+			t.Fatalf("set peer addr %v", err)
+		}
+		if err = SetLinkUp("eth0"); err != nil {
+			t.Fatalf("set peer up %v", err)
+		}
+		if err = AddDefaultRoute("eth0", net.ParseIP("10.99.0.1")); err != nil {
+			t.Fatalf("add default route %v", err)
+		}
+
+		// 删除 veth 一端，另一端也会被删除
+		if err = DeleteLink("testveth0"); err != nil {
+			t.Fatalf("delete veth %v", err)
+		}
+		if exist, _ := LinkExists("eth0"); exist {
+			t.Fatalf("veth peer should be deleted")
+		}
+		if err = DeleteLink("testveth0"); err != nil {
+			t.Fatalf("delete not exist link should not fail %v", err)
+		}
+	})
+}
@@ -0,0 +1,474 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"mydocker/constant"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const (
+	// DefaultNetwork 默认网络，--net bridge 时容器会接入这个网络，网络名同时也是 bridge 设备名
+	DefaultNetwork = "mydocker0"
+	// DefaultSubnet 默认网络使用的网段
+	DefaultSubnet = "172.18.0.0/16"
+	// ContainerIfName 容器内网卡名
+	ContainerIfName = "eth0"
+	vethPrefix      = "veth"
+	peerPrefix      = "cif"
+
+	defaultNetworkPath = "/var/lib/mydocker/network/network/"
+	// 网段前缀长度的范围，/30 只剩网关和一个容器地址，/16 时 IPAM 位图已经有 65536 位
+	minSubnetPrefix = 16
+	maxSubnetPrefix = 30
+)
+
+// ErrNetworkNotFound 网络不存在
+var ErrNetworkNotFound = errors.New("network not found")
+
+// networkNameRegexp 网络名同时也是 bridge 设备名，因此需要满足网卡名的限制，长度不超过 15
+var networkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,14}$`)
+
+// Network 网络，由驱动、网段以及名字组成
+type Network struct {
+	Name      string     `json:"name"`                // 网络名
+	IPRange   *net.IPNet `json:"ipRange"`             // 网段
+	IPv6Range *net.IPNet `json:"ipv6Range,omitempty"` // IPv6 网段，未开启 IPv6 时为空
+	Driver    string     `json:"driver"`              // 网络驱动名
+}
+
+// Endpoint 网络端点，用于连接容器与网络，保存 veth、IP、MAC 等信息
+type Endpoint struct {
+	ID         string           `json:"id"`   // 端点 Id，和容器 Id 一致
+	Device     string           `json:"dev"`  // 宿主机一端的 veth 名
+	PeerName   string           `json:"peer"` // 容器一端的 veth 名，移入容器后会被重命名为 ContainerIfName
+	IPAddress  net.IP           `json:"ip"`   // 分配给容器的 IP
+	MacAddress net.HardwareAddr `json:"mac"`  // 容器网卡 MAC
+	Network    *Network         `json:"network"`
+}
+
+// Driver 网络驱动，不同驱动对网络的创建、连接、销毁方式不同
+type Driver interface {
+	// Name 驱动名
+	Name() string
+	// Create 创建网络
+	Create(subnet string, name string) (*Network, error)
+	// Delete 删除网络
+	Delete(network *Network) error
+	// Connect 将端点连接到网络，负责创建 veth 并将宿主机一端挂到网络上
+	Connect(network *Network, endpoint *Endpoint) error
+	// Disconnect 将端点从网络中断开
+	Disconnect(network *Network, endpoint *Endpoint) error
+}
+
+var drivers = map[string]Driver{}
+
+func init() {
+	bridgeDriver := &BridgeNetworkDriver{}
+	drivers[bridgeDriver.Name()] = bridgeDriver
+}
+
+// Connect 将容器连接到指定网络
+/*
+1. 找到网络，默认网络不存在时自动创建
+2. 分配 IP，创建 veth 并将宿主机一端接入 bridge
+3. 进入容器 Net Namespace，为容器一端配置 IP、路由并启动
+*/
+func Connect(networkName, containerId string, pid int) (*Endpoint, error) {
+	nw, err := loadNetwork(networkName)
+	if err != nil {
+		return nil, err
+	}
+	// 从 IPAM 中分配 IP，后续任何一步失败都需要把 IP 还回去
+	ip, err := ipAllocator.Allocate(nw.IPRange)
+	if err != nil {
+		return nil, err
+	}
+	ep := &Endpoint{
+		ID:        containerId,
+		Device:    vethPrefix + containerId,
+		PeerName:  peerPrefix + containerId,
+		IPAddress: ip,
+		Network:   nw,
+	}
+	driver, ok := drivers[nw.Driver]
+	if !ok {
+		_ = ipAllocator.Release(nw.IPRange, ip)
+		return nil, fmt.Errorf("network driver %s not found", nw.Driver)
+	}
+	if err = driver.Connect(nw, ep); err != nil {
+		_ = ipAllocator.Release(nw.IPRange, ip)
+		return nil, err
+	}
+	if err = configEndpointIpAddressAndRoute(ep, pid); err != nil {
+		_ = driver.Disconnect(nw, ep)
+		_ = ipAllocator.Release(nw.IPRange, ip)
+		return nil, err
+	}
+	return ep, nil
+}
+
+// Disconnect 将容器从网络断开，删除宿主机上残留的 veth 并释放容器 IP
+func Disconnect(networkName, containerId, ip string) error {
+	if networkName == "" {
+		return nil
+	}
+	nw, err := LoadNetwork(networkName)
+	if err != nil {
+		return err
+	}
+	driver, ok := drivers[nw.Driver]
+	if !ok {
+		return fmt.Errorf("network driver %s not found", nw.Driver)
+	}
+	ep := &Endpoint{
+		ID:       containerId,
+		Device:   vethPrefix + containerId,
+		PeerName: peerPrefix + containerId,
+		Network:  nw,
+	}
+	if err = driver.Disconnect(nw, ep); err != nil {
+		return err
+	}
+	if ip == "" {
+		return nil
+	}
+	return ipAllocator.Release(nw.IPRange, net.ParseIP(ip))
+}
+
+// CreateNetwork 创建网络
+/*
+1. 检查网络名、网段是否合法，是否与已有网络冲突
+2. 通过 IPAM 保留网关地址
+3. 调用驱动创建网络，指定了 IPv6 网段时为 bridge 配置 IPv6 网关，并将网络信息保存到文件
+*/
+func CreateNetwork(driver, subnet, ipv6Subnet, name string) (*Network, error) {
+	if !networkNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %s, must match %s", name, networkNameRegexp.String())
+	}
+	d, ok := drivers[driver]
+	if !ok {
+		return nil, fmt.Errorf("network driver %s not supported", driver)
+	}
+	_, cidr, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse subnet %s", subnet)
+	}
+	if cidr.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %s is not an ipv4 subnet", subnet)
+	}
+	if ones, _ := cidr.Mask.Size(); ones < minSubnetPrefix || ones > maxSubnetPrefix {
+		return nil, fmt.Errorf("prefix length of subnet %s must be between /%d and /%d",
+			subnet, minSubnetPrefix, maxSubnetPrefix)
+	}
+	var ipv6Range *net.IPNet
+	if ipv6Subnet != "" {
+		if ipv6Range, err = ParseIPv6Subnet(ipv6Subnet); err != nil {
+			return nil, err
+		}
+	}
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, nw := range networks {
+		if nw.Name == name {
+			return nil, fmt.Errorf("network %s already exists", name)
+		}
+		if nw.IPRange.Contains(cidr.IP) || cidr.Contains(nw.IPRange.IP) {
+			return nil, fmt.Errorf("subnet %s overlaps with network %s(%s)", subnet, nw.Name, nw.IPRange.String())
+		}
+		if ipv6Range != nil && nw.IPv6Range != nil &&
+			(nw.IPv6Range.Contains(ipv6Range.IP) || ipv6Range.Contains(nw.IPv6Range.IP)) {
+			return nil, fmt.Errorf("ipv6 subnet %s overlaps with network %s(%s)", ipv6Subnet, nw.Name, nw.IPv6Range.String())
+		}
+	}
+
+	if _, err = ipAllocator.ReserveGateway(cidr); err != nil {
+		return nil, err
+	}
+	if ipv6Range != nil {
+		if _, err = ipAllocator.ReserveGateway(ipv6Range); err != nil {
+			_ = ipAllocator.Delete(cidr)
+			return nil, err
+		}
+	}
+	nw, err := d.Create(cidr.String(), name)
+	if err == nil {
+		nw.IPv6Range = ipv6Range
+		if err = setupIPv6(nw); err == nil {
+			err = nw.dump(defaultNetworkPath)
+		}
+		if err != nil {
+			_ = d.Delete(nw)
+		}
+	}
+	if err != nil {
+		_ = ipAllocator.Delete(cidr)
+		if ipv6Range != nil {
+			_ = ipAllocator.Delete(ipv6Range)
+		}
+		return nil, err
+	}
+	return nw, nil
+}
+
+// DeleteNetwork 删除网络，是否还有容器连接在网络上需要由调用方检查
+func DeleteNetwork(networkName string) error {
+	nw, err := LoadNetwork(networkName)
+	if err != nil {
+		return err
+	}
+	d, ok := drivers[nw.Driver]
+	if !ok {
+		return fmt.Errorf("network driver %s not found", nw.Driver)
+	}
+	if err = d.Delete(nw); err != nil {
+		log.Errorf("delete network %s by driver %s error %v", nw.Name, nw.Driver, err)
+	}
+	if err = ipAllocator.Delete(nw.IPRange); err != nil {
+		return errors.WithMessagef(err, "delete ipam of network %s", nw.Name)
+	}
+	if nw.IPv6Range != nil {
+		if err = ipAllocator.Delete(nw.IPv6Range); err != nil {
+			return errors.WithMessagef(err, "delete ipv6 ipam of network %s", nw.Name)
+		}
+	}
+	return nw.remove(defaultNetworkPath)
+}
+
+// ListNetworks 读取所有保存的网络
+func ListNetworks() ([]*Network, error) {
+	files, err := os.ReadDir(defaultNetworkPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read dir %s", defaultNetworkPath)
+	}
+	networks := make([]*Network, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		nw := &Network{Name: strings.TrimSuffix(file.Name(), ".json")}
+		if err = nw.load(defaultNetworkPath); err != nil {
+			log.Errorf("load network %s error %v", nw.Name, err)
+			continue
+		}
+		networks = append(networks, nw)
+	}
+	return networks, nil
+}
+
+// LoadNetwork 根据网络名读取网络信息，bridge 作为默认网络的别名
+func LoadNetwork(networkName string) (*Network, error) {
+	if networkName == "bridge" {
+		networkName = DefaultNetwork
+	}
+	nw := &Network{Name: networkName}
+	err := nw.load(defaultNetworkPath)
+	if err == nil {
+		return nw, nil
+	}
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrapf(ErrNetworkNotFound, "network %s", networkName)
+	}
+	return nil, err
+}
+
+// loadNetwork 读取容器要连接的网络，默认网络在第一次使用时创建
+// 网络设备不存在时(比如宿主机重启后)由驱动重新创建
+func loadNetwork(networkName string) (*Network, error) {
+	nw, err := LoadNetwork(networkName)
+	if errors.Is(err, ErrNetworkNotFound) && (networkName == "bridge" || networkName == DefaultNetwork) {
+		return CreateNetwork("bridge", DefaultSubnet, "", DefaultNetwork)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exist, err := LinkExists(nw.Name); err != nil || exist {
+		return nw, err
+	}
+	d, ok := drivers[nw.Driver]
+	if !ok {
+		return nil, fmt.Errorf("network driver %s not found", nw.Driver)
+	}
+	if _, err = d.Create(nw.IPRange.String(), nw.Name); err != nil {
+		return nil, err
+	}
+	if err = setupIPv6(nw); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
+func (nw *Network) dump(dumpPath string) error {
+	if err := os.MkdirAll(dumpPath, constant.Perm0755); err != nil {
+		return errors.Wrapf(err, "mkdir %s", dumpPath)
+	}
+	nwJson, err := json.Marshal(nw)
+	if err != nil {
+		return errors.Wrapf(err, "marshal network %s", nw.Name)
+	}
+	nwPath := path.Join(dumpPath, nw.Name+".json")
+	if err = os.WriteFile(nwPath, nwJson, constant.Perm0644); err != nil {
+		return errors.Wrapf(err, "write %s", nwPath)
+	}
+	return nil
+}
+
+func (nw *Network) remove(dumpPath string) error {
+	nwPath := path.Join(dumpPath, nw.Name+".json")
+	if err := os.Remove(nwPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove %s", nwPath)
+	}
+	return nil
+}
+
+func (nw *Network) load(dumpPath string) error {
+	nwPath := path.Join(dumpPath, nw.Name+".json")
+	nwJson, err := os.ReadFile(nwPath)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", nwPath)
+	}
+	return json.Unmarshal(nwJson, nw)
+}
+
+// MarshalJSON 网段以 CIDR 字符串形式保存，例如 172.18.0.0/16
+func (nw *Network) MarshalJSON() ([]byte, error) {
+	type alias Network
+	aux := &struct {
+		*alias
+		IPRange   string `json:"ipRange"`
+		IPv6Range string `json:"ipv6Range,omitempty"`
+	}{alias: (*alias)(nw), IPRange: nw.IPRange.String()}
+	if nw.IPv6Range != nil {
+		aux.IPv6Range = nw.IPv6Range.String()
+	}
+	return json.Marshal(aux)
+}
+
+func (nw *Network) UnmarshalJSON(data []byte) error {
+	type alias Network
+	aux := &struct {
+		*alias
+		IPRange   string `json:"ipRange"`
+		IPv6Range string `json:"ipv6Range,omitempty"`
+	}{alias: (*alias)(nw)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	_, ipRange, err := net.ParseCIDR(aux.IPRange)
+	if err != nil {
+		return errors.Wrapf(err, "parse ipRange of network %s", nw.Name)
+	}
+	nw.IPRange = ipRange
+	if aux.IPv6Range != "" {
+		if _, nw.IPv6Range, err = net.ParseCIDR(aux.IPv6Range); err != nil {
+			return errors.Wrapf(err, "parse ipv6Range of network %s", nw.Name)
+		}
+	}
+	return nil
+}
+
+// Gateway 网络的网关地址
+func (nw *Network) Gateway() net.IP {
+	return gatewayIP(nw.IPRange)
+}
+
+// gatewayIP 网段中的第一个地址作为网关
+func gatewayIP(subnet *net.IPNet) net.IP {
+	return nthIP(subnet, 1)
+}
+
+// enterContainerNetNS 将当前线程切换到容器的 Net Namespace，返回的函数用于切换回原来的 Namespace
+/*
+Go 的 goroutine 会在不同线程间调度，而 Namespace 是线程级别的，因此这里需要 LockOSThread 锁定当前线程，
+否则后续代码可能在其他线程上执行，从而不在容器的 Net Namespace 中。
+*/
+func enterContainerNetNS(pid int) (func(), error) {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/ns/net", pid), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open netns of pid %d", pid)
+	}
+	nsFD := f.Fd()
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		_ = f.Close()
+		return nil, errors.Wrap(err, "get current netns")
+	}
+	if err = netns.Set(netns.NsHandle(nsFD)); err != nil {
+		_ = origin.Close()
+		runtime.UnlockOSThread()
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "set netns of pid %d", pid)
+	}
+	return func() {
+		if err := netns.Set(origin); err != nil {
+			log.Errorf("restore netns error %v", err)
+		}
+		_ = origin.Close()
+		runtime.UnlockOSThread()
+		_ = f.Close()
+	}, nil
+}
+
+// configEndpointIpAddressAndRoute 将 veth 的容器一端移入容器 Net Namespace 并配置 IP 和默认路由
+// 容器的 lo 网卡由 init 进程负责启动
+func configEndpointIpAddressAndRoute(ep *Endpoint, pid int) error {
+	ones, _ := ep.Network.IPRange.Mask.Size()
+	mac, err := configContainerLink(pid, ep.PeerName, ContainerIfName,
+		fmt.Sprintf("%s/%d", ep.IPAddress.String(), ones), gatewayIP(ep.Network.IPRange))
+	if err != nil {
+		return err
+	}
+	ep.MacAddress = mac
+	return nil
+}
+
+// configContainerLink 将宿主机上的网卡移入容器 Net Namespace，重命名为 ifName 后配置地址、启动网卡
+// gw 不为空时添加默认路由，所有流量都经过网关转发出去
+func configContainerLink(pid int, linkName, ifName, cidr string, gw net.IP) (net.HardwareAddr, error) {
+	if err := SetLinkNsByPid(linkName, pid); err != nil {
+		return nil, err
+	}
+
+	exit, err := enterContainerNetNS(pid)
+	if err != nil {
+		return nil, err
+	}
+	defer exit()
+
+	if err = RenameLink(linkName, ifName); err != nil {
+		return nil, err
+	}
+	if err = SetLinkAddr(ifName, cidr); err != nil {
+		return nil, err
+	}
+	if err = SetLinkUp(ifName); err != nil {
+		return nil, err
+	}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get link %s", ifName)
+	}
+	if gw != nil {
+		if err = AddDefaultRoute(ifName, gw); err != nil {
+			return nil, err
+		}
+	}
+	return link.Attrs().HardwareAddr, nil
+}
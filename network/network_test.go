@@ -0,0 +1,19 @@
+package network
+
+import "testing"
+
+func TestCreateNetworkInvalidSubnet(t *testing.T) {
+	// 校验失败时不会创建 bridge，也不会写入网络和 IPAM 文件
+	for _, subnets := range [][2]string{
+		{"10.0.0.1/32", ""},
+		{"10.0.0.0/31", ""},
+		{"10.0.0.0/8", ""},
+		{"fd00:10::/64", ""},
+		{"10.20.0.0/24", "10.30.0.0/24"},
+		{"10.20.0.0/24", "fd00:10::/127"},
+	} {
+		if _, err := CreateNetwork("bridge", subnets[0], subnets[1], "testnet"); err == nil {
+			t.Fatalf("create network with subnet %v should fail", subnets)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// PortMapping 端口映射，将宿主机端口映射到容器端口
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"` // tcp 或 udp
+}
+
+// ParsePortMapping 解析端口映射，格式为 hostPort:containerPort[/proto]，例如 8080:80、53:53/udp，协议默认 tcp
+func ParsePortMapping(raw string) (*PortMapping, error) {
+	pm := &PortMapping{Protocol: "tcp"}
+	ports := raw
+	if idx := strings.LastIndex(raw, "/"); idx >= 0 {
+		ports, pm.Protocol = raw[:idx], strings.ToLower(raw[idx+1:])
+	}
+	if pm.Protocol != "tcp" && pm.Protocol != "udp" {
+		return nil, fmt.Errorf("invalid port mapping [%s], protocol must be tcp or udp", raw)
+	}
+	parts := strings.Split(ports, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid port mapping [%s], must split by `:`", raw)
+	}
+	var err error
+	if pm.HostPort, err = parsePort(parts[0]); err != nil {
+		return nil, errors.WithMessagef(err, "invalid port mapping [%s]", raw)
+	}
+	if pm.ContainerPort, err = parsePort(parts[1]); err != nil {
+		return nil, errors.WithMessagef(err, "invalid port mapping [%s]", raw)
+	}
+	return pm, nil
+}
+
+// ParsePortMappings 批量解析端口映射
+func ParsePortMappings(raws []string) ([]*PortMapping, error) {
+	portMappings := make([]*PortMapping, 0, len(raws))
+	for _, raw := range raws {
+		pm, err := ParsePortMapping(raw)
+		if err != nil {
+			return nil, err
+		}
+		portMappings = append(portMappings, pm)
+	}
+	return portMappings, nil
+}
+
+func parsePort(raw string) (int, error) {
+	port, err := strconv.Atoi(raw)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %s", raw)
+	}
+	return port, nil
+}
+
+// String 返回 hostPort:containerPort/proto 格式，和 ParsePortMapping 对应
+func (pm *PortMapping) String() string {
+	return fmt.Sprintf("%d:%d/%s", pm.HostPort, pm.ContainerPort, pm.Protocol)
+}
+
+// ConfigPortMapping 为容器设置端口映射
+/*
+1. PREROUTING DNAT：外部访问宿主机端口的流量转发到容器
+2. OUTPUT DNAT：宿主机本机访问自身端口的流量转发到容器
+3. FORWARD ACCEPT：避免 FORWARD 链默认策略为 DROP 时流量被丢弃
+*/
+func ConfigPortMapping(containerIP string, portMappings []*PortMapping) error {
+	for i, pm := range portMappings {
+		for _, rule := range portMappingRules(containerIP, pm) {
+			if err := appendRule(rule); err != nil {
+				// 配置失败时回滚已经添加的规则
+				DeletePortMapping(containerIP, portMappings[:i+1])
+				return errors.WithMessagef(err, "port mapping %s", pm.String())
+			}
+		}
+	}
+	return nil
+}
+
+// DeletePortMapping 删除容器的端口映射规则，规则不存在时直接跳过
+func DeletePortMapping(containerIP string, portMappings []*PortMapping) {
+	for _, pm := range portMappings {
+		for _, rule := range portMappingRules(containerIP, pm) {
+			if err := deleteRule(rule); err != nil {
+				log.Errorf("delete port mapping %s of %s error %v", pm.String(), containerIP, err)
+			}
+		}
+	}
+}
+
+func portMappingRules(containerIP string, pm *PortMapping) [][]string {
+	hostPort := strconv.Itoa(pm.HostPort)
+	containerPort := strconv.Itoa(pm.ContainerPort)
+	destination := fmt.Sprintf("%s:%d", containerIP, pm.ContainerPort)
+	return [][]string{
+		// iptables -t nat -A PREROUTING -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.18.0.2:80
+		{"-t", "nat", "PREROUTING", "-p", pm.Protocol, "-m", pm.Protocol, "--dport", hostPort,
+			"-j", "DNAT", "--to-destination", destination},
+		// iptables -t nat -A OUTPUT -p tcp -m tcp --dport 8080 -m addrtype --dst-type LOCAL -j DNAT --to-destination 172.18.0.2:80
+		{"-t", "nat", "OUTPUT", "-p", pm.Protocol, "-m", pm.Protocol, "--dport", hostPort,
+			"-m", "addrtype", "--dst-type", "LOCAL", "-j", "DNAT", "--to-destination", destination},
+		// iptables -t filter -A FORWARD -d 172.18.0.2 -p tcp -m tcp --dport 80 -j ACCEPT
+		{"-t", "filter", "FORWARD", "-d", containerIP, "-p", pm.Protocol, "-m", pm.Protocol, "--dport", containerPort,
+			"-j", "ACCEPT"},
+	}
+}
+
+// appendRule rule 的格式为 -t table chain args...，已存在时不再重复添加
+func appendRule(rule []string) error {
+	if ruleExists(rule) {
+		return nil
+	}
+	return iptables(ruleArgs("-A", rule)...)
+}
+
+func deleteRule(rule []string) error {
+	if !ruleExists(rule) {
+		return nil
+	}
+	return iptables(ruleArgs("-D", rule)...)
+}
+
+func ruleExists(rule []string) bool {
+	return iptables(ruleArgs("-C", rule)...) == nil
+}
+
+func ruleArgs(action string, rule []string) []string {
+	args := make([]string, 0, len(rule)+1)
+	args = append(args, rule[:2]...)
+	args = append(args, action)
+	return append(args, rule[2:]...)
+}
@@ -0,0 +1,26 @@
+package network
+
+import "testing"
+
+func TestParsePortMapping(t *testing.T) {
+	valid := map[string]string{
+		"8080:80":      "8080:80/tcp",
+		"53:53/udp":    "53:53/udp",
+		"443:8443/TCP": "443:8443/tcp",
+	}
+	for raw, expect := range valid {
+		pm, err := ParsePortMapping(raw)
+		if err != nil {
+			t.Fatalf("parse %s %v", raw, err)
+		}
+		if pm.String() != expect {
+			t.Fatalf("parse %s expect %s, got %s", raw, expect, pm.String())
+		}
+	}
+
+	for _, raw := range []string{"8080", "8080:80/sctp", "0:80", "8080:65536", "a:80", "1:2:3"} {
+		if _, err := ParsePortMapping(raw); err == nil {
+			t.Fatalf("parse %s should fail", raw)
+		}
+	}
+}
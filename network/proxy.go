@@ -0,0 +1,204 @@
+package network
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mydocker/constant"
+	"mydocker/utils"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	proxyPidFormat = "proxy-%d-%s.pid"
+	udpConnTimeout = 90 * time.Second
+	udpBufSize     = 65507
+)
+
+// StartUserlandProxy 为每个端口映射启动一个 userland proxy 进程，并在 pidDir 下记录进程 PID
+/*
+proxy 进程是通过 /proc/self/exe proxy 启动的 mydocker 自身，在宿主机上监听 hostPort，
+将收到的连接转发到容器 IP 的 containerPort 上，适用于无法使用 iptables 的环境。
+*/
+func StartUserlandProxy(pidDir, containerIP string, portMappings []*PortMapping) error {
+	if err := os.MkdirAll(pidDir, constant.Perm0622); err != nil {
+		return errors.Wrapf(err, "mkdir %s", pidDir)
+	}
+	for _, pm := range portMappings {
+		cmd := exec.Command("/proc/self/exe", "proxy",
+			"-proto", pm.Protocol,
+			"-host-port", strconv.Itoa(pm.HostPort),
+			"-container-ip", containerIP,
+			"-container-port", strconv.Itoa(pm.ContainerPort))
+		// 使用新的 session，避免前台容器退出时 proxy 进程收到终端信号
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		logFile, err := os.Create(path.Join(pidDir, fmt.Sprintf("proxy-%d-%s.log", pm.HostPort, pm.Protocol)))
+		if err != nil {
+			StopUserlandProxy(pidDir)
+			return errors.Wrapf(err, "create log file of proxy %s", pm.String())
+		}
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		// 等待 proxy 监听 hostPort 成功，端口被占用时 proxy 进程会直接退出
+		err = utils.StartAndWaitReady(cmd, utils.ReadyTimeout)
+		_ = logFile.Close()
+		if err != nil {
+			StopUserlandProxy(pidDir)
+			return errors.WithMessagef(err, "start proxy %s", pm.String())
+		}
+		pidFile := path.Join(pidDir, fmt.Sprintf(proxyPidFormat, pm.HostPort, pm.Protocol))
+		if err = os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), constant.Perm0644); err != nil {
+			_ = cmd.Process.Kill()
+			StopUserlandProxy(pidDir)
+			return errors.Wrapf(err, "write pid file %s", pidFile)
+		}
+		// proxy 进程独立运行，这里释放掉子进程资源，不等待它退出
+		_ = cmd.Process.Release()
+	}
+	return nil
+}
+
+// StopUserlandProxy 根据 pidDir 下的 PID 文件停止所有 proxy 进程
+func StopUserlandProxy(pidDir string) {
+	pidFiles, err := filepath.Glob(path.Join(pidDir, "proxy-*.pid"))
+	if err != nil {
+		log.Errorf("glob proxy pid files in %s error %v", pidDir, err)
+		return
+	}
+	for _, pidFile := range pidFiles {
+		content, err := os.ReadFile(pidFile)
+		if err != nil {
+			log.Errorf("read pid file %s error %v", pidFile, err)
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			log.Errorf("invalid pid in %s error %v", pidFile, err)
+			continue
+		}
+		if err = syscall.Kill(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Errorf("kill proxy %d error %v", pid, err)
+			continue
+		}
+		_ = os.Remove(pidFile)
+	}
+}
+
+// RunUserlandProxy 在当前进程中运行 proxy，监听成功后通知 StartUserlandProxy，然后阻塞直到出错
+func RunUserlandProxy(proto string, hostPort int, containerIP string, containerPort int) error {
+	hostAddr := fmt.Sprintf("0.0.0.0:%d", hostPort)
+	containerAddr := net.JoinHostPort(containerIP, strconv.Itoa(containerPort))
+	switch proto {
+	case "tcp":
+		listener, err := net.Listen("tcp", hostAddr)
+		if err != nil {
+			return errors.Wrapf(err, "listen tcp %s", hostAddr)
+		}
+		utils.NotifyReady()
+		return proxyTCP(listener, containerAddr)
+	case "udp":
+		conn, err := net.ListenPacket("udp", hostAddr)
+		if err != nil {
+			return errors.Wrapf(err, "listen udp %s", hostAddr)
+		}
+		utils.NotifyReady()
+		return proxyUDP(conn, containerAddr)
+	default:
+		return fmt.Errorf("unsupported protocol %s", proto)
+	}
+}
+
+// proxyTCP 每接收一个连接就连接一次容器，然后在两个连接之间双向拷贝数据
+func proxyTCP(listener net.Listener, containerAddr string) error {
+	defer listener.Close()
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "accept")
+		}
+		go func() {
+			defer client.Close()
+			backend, err := net.Dial("tcp", containerAddr)
+			if err != nil {
+				log.Errorf("dial %s error %v", containerAddr, err)
+				return
+			}
+			defer backend.Close()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go pipeTCP(client, backend, &wg)
+			go pipeTCP(backend, client, &wg)
+			wg.Wait()
+		}()
+	}
+}
+
+func pipeTCP(dst, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	_, _ = io.Copy(dst, src)
+	// 一个方向结束后关闭写端，让另一端读到 EOF
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+}
+
+// proxyUDP 为每个客户端地址建立一个到容器的 UDP 连接，容器的回包再通过监听的端口发回给客户端
+// 连接在 udpConnTimeout 内没有收到回包就会被回收
+func proxyUDP(conn net.PacketConn, containerAddr string) error {
+	defer conn.Close()
+	var (
+		mu       sync.Mutex
+		backends = map[string]net.Conn{}
+		buf      = make([]byte, udpBufSize)
+	)
+	for {
+		n, clientAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return errors.Wrap(err, "read udp")
+		}
+		mu.Lock()
+		backend, ok := backends[clientAddr.String()]
+		if !ok {
+			backend, err = net.Dial("udp", containerAddr)
+			if err != nil {
+				mu.Unlock()
+				log.Errorf("dial %s error %v", containerAddr, err)
+				continue
+			}
+			backends[clientAddr.String()] = backend
+			go func(clientAddr net.Addr, backend net.Conn) {
+				defer func() {
+					mu.Lock()
+					delete(backends, clientAddr.String())
+					mu.Unlock()
+					_ = backend.Close()
+				}()
+				reply := make([]byte, udpBufSize)
+				for {
+					_ = backend.SetReadDeadline(time.Now().Add(udpConnTimeout))
+					n, err := backend.Read(reply)
+					if err != nil {
+						return
+					}
+					if _, err = conn.WriteTo(reply[:n], clientAddr); err != nil {
+						return
+					}
+				}
+			}(clientAddr, backend)
+		}
+		mu.Unlock()
+		if _, err = backend.Write(buf[:n]); err != nil {
+			log.Errorf("write udp to %s error %v", containerAddr, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// InterfaceStats 网卡的流量统计，对应 /proc/net/dev 中的一行
+type InterfaceStats struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rxBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxErrors  uint64 `json:"rxErrors"`
+	RxDropped uint64 `json:"rxDropped"`
+	TxBytes   uint64 `json:"txBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	TxErrors  uint64 `json:"txErrors"`
+	TxDropped uint64 `json:"txDropped"`
+}
+
+// GetInterfaceStats 获取进程 pid 所在 Net Namespace 中所有网卡的流量统计
+// /proc/<pid>/net/dev 展示的是进程所在 Net Namespace 的内容，因此不需要切换 Namespace
+func GetInterfaceStats(pid int) ([]*InterfaceStats, error) {
+	devPath := fmt.Sprintf("/proc/%d/net/dev", pid)
+	f, err := os.Open(devPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", devPath)
+	}
+	defer f.Close()
+	stats, err := parseNetDev(f)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "parse %s", devPath)
+	}
+	return stats, nil
+}
+
+// parseNetDev 解析 /proc/net/dev 格式的内容，前两行为表头，之后每行格式为
+// <name>: <rx bytes> <rx packets> <rx errs> <rx drop> <4 列其他接收统计> <tx bytes> <tx packets> <tx errs> <tx drop> ...
+func parseNetDev(r io.Reader) ([]*InterfaceStats, error) {
+	var stats []*InterfaceStats
+	scanner := bufio.NewScanner(r)
+	for line := 0; scanner.Scan(); line++ {
+		if line < 2 {
+			continue
+		}
+		name, counters, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			return nil, fmt.Errorf("invalid line %q", scanner.Text())
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("invalid counters of interface %s", strings.TrimSpace(name))
+		}
+		values := make([]uint64, len(fields))
+		for i, field := range fields {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse counter of interface %s", strings.TrimSpace(name))
+			}
+			values[i] = value
+		}
+		stats = append(stats, &InterfaceStats{
+			Name:      strings.TrimSpace(name),
+			RxBytes:   values[0],
+			RxPackets: values[1],
+			RxErrors:  values[2],
+			RxDropped: values[3],
+			TxBytes:   values[8],
+			TxPackets: values[9],
+			TxErrors:  values[10],
+			TxDropped: values[11],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
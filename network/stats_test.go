@@ -0,0 +1,44 @@
+package network
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseNetDev(t *testing.T) {
+	content := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1200      12    0    0    0     0          0         0     1200      12    0    0    0     0       0          0
+  eth0: 3456789    2345    1    2    0     0          0         0   123456     987    3    4    0     0       0          0
+`
+	stats, err := parseNetDev(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parse %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expect 2 interfaces, got %d", len(stats))
+	}
+	eth0 := stats[1]
+	if eth0.Name != "eth0" || eth0.RxBytes != 3456789 || eth0.RxPackets != 2345 || eth0.RxErrors != 1 ||
+		eth0.RxDropped != 2 || eth0.TxBytes != 123456 || eth0.TxPackets != 987 || eth0.TxErrors != 3 || eth0.TxDropped != 4 {
+		t.Fatalf("unexpected stats %+v", eth0)
+	}
+
+	if _, err = parseNetDev(strings.NewReader("h1\nh2\neth0: 1 2 3\n")); err == nil {
+		t.Fatalf("parse invalid content should fail")
+	}
+}
+
+func TestGetInterfaceStats(t *testing.T) {
+	stats, err := GetInterfaceStats(os.Getpid())
+	if err != nil {
+		t.Fatalf("get stats %v", err)
+	}
+	for _, s := range stats {
+		if s.Name == "lo" {
+			return
+		}
+	}
+	t.Fatalf("lo not found in %v", stats)
+}
@@ -0,0 +1,55 @@
+// cni-stub 测试用的 CNI 插件，记录每次调用的参数，ADD 时返回配置中的地址
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type config struct {
+	CNIVersion string          `json:"cniVersion"`
+	Name       string          `json:"name"`
+	Address    string          `json:"address"`
+	LogFile    string          `json:"logFile"`
+	Fail       bool            `json:"fail"`
+	PrevResult json.RawMessage `json:"prevResult"`
+}
+
+func main() {
+	var conf config
+	if err := json.NewDecoder(os.Stdin).Decode(&conf); err != nil {
+		fail(conf.CNIVersion, 6, "decode config: "+err.Error())
+	}
+	command := os.Getenv("CNI_COMMAND")
+	if conf.LogFile != "" {
+		f, err := os.OpenFile(conf.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fail(conf.CNIVersion, 999, err.Error())
+		}
+		_, _ = fmt.Fprintf(f, "%s %s %s %s %s %t\n", command, conf.Address, os.Getenv("CNI_CONTAINERID"),
+			os.Getenv("CNI_NETNS"), os.Getenv("CNI_IFNAME"), len(conf.PrevResult) > 0)
+		_ = f.Close()
+	}
+	if conf.Fail {
+		fail(conf.CNIVersion, 7, "stub failure")
+	}
+	if command != "ADD" {
+		return
+	}
+	// 插件链中后面的插件直接透传前一个插件的结果
+	if len(conf.PrevResult) > 0 {
+		_, _ = os.Stdout.Write(conf.PrevResult)
+		return
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"cniVersion": conf.CNIVersion,
+		"interfaces": []map[string]string{{"name": os.Getenv("CNI_IFNAME"), "sandbox": os.Getenv("CNI_NETNS")}},
+		"ips":        []map[string]interface{}{{"address": conf.Address, "interface": 0}},
+	})
+}
+
+func fail(version string, code int, msg string) {
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"cniVersion": version, "code": code, "msg": msg})
+	os.Exit(1)
+}
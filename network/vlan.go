@@ -0,0 +1,85 @@
+package network
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"net"
+	"strings"
+)
+
+const (
+	Macvlan = "macvlan"
+	Ipvlan  = "ipvlan"
+	// 子接口在宿主机上创建时使用的临时名字前缀，移入容器后会被重命名为 ContainerIfName
+	subInterfacePrefix = "sub"
+)
+
+// SubInterfaceConfig macvlan/ipvlan 子接口配置，对应 --net macvlan:<parent>,<cidr>[,<gateway>]
+type SubInterfaceConfig struct {
+	Parent  string     // 宿主机上的父接口，例如 eth0
+	Address *net.IPNet // 容器的地址，IP 为容器 IP，掩码为所在网段的掩码
+	Gateway net.IP     // 默认网关，为空时只有网段路由
+}
+
+// ParseSubInterfaceConfig 解析 <parent>,<cidr>[,<gateway>] 格式的参数
+func ParseSubInterfaceConfig(arg string) (*SubInterfaceConfig, error) {
+	parts := strings.Split(arg, ",")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid sub interface config [%s], must be <parent>,<cidr>[,<gateway>]", arg)
+	}
+	ip, ipNet, err := net.ParseCIDR(parts[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse address %s", parts[1])
+	}
+	config := &SubInterfaceConfig{
+		Parent:  parts[0],
+		Address: &net.IPNet{IP: ip, Mask: ipNet.Mask},
+	}
+	if len(parts) == 3 {
+		if config.Gateway = net.ParseIP(parts[2]); config.Gateway == nil {
+			return nil, fmt.Errorf("invalid gateway %s", parts[2])
+		}
+		if !ipNet.Contains(config.Gateway) {
+			return nil, fmt.Errorf("gateway %s not in subnet %s", parts[2], ipNet.String())
+		}
+	}
+	return config, nil
+}
+
+// ConnectSubInterface 为容器创建 macvlan 或 ipvlan 子接口，让容器直接出现在父接口所在的二层网络中
+/*
+1. 在宿主机上基于父接口创建子接口，macvlan 使用 bridge 模式，ipvlan 使用 l2 模式
+2. 将子接口移入容器的 Net Namespace
+3. 在容器中重命名为 eth0，配置地址、启动网卡并添加默认路由
+子接口属于容器的 Net Namespace，容器退出后会被内核自动删除，因此不需要单独清理。
+*/
+func ConnectSubInterface(kind, containerId string, pid int, config *SubInterfaceConfig) (net.HardwareAddr, error) {
+	parent, err := netlink.LinkByName(config.Parent)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get parent link %s", config.Parent)
+	}
+	la := netlink.NewLinkAttrs()
+	la.Name = subInterfacePrefix + containerId
+	la.ParentIndex = parent.Attrs().Index
+
+	var link netlink.Link
+	switch kind {
+	case Macvlan:
+		link = &netlink.Macvlan{LinkAttrs: la, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	case Ipvlan:
+		link = &netlink.IPVlan{LinkAttrs: la, Mode: netlink.IPVLAN_MODE_L2}
+	default:
+		return nil, fmt.Errorf("unsupported sub interface type %s", kind)
+	}
+	if err = netlink.LinkAdd(link); err != nil {
+		return nil, errors.Wrapf(err, "add %s link on %s", kind, config.Parent)
+	}
+	mac, err := configContainerLink(pid, la.Name, ContainerIfName, config.Address.String(), config.Gateway)
+	if err != nil {
+		// 还没有移入容器时需要手动删除
+		_ = DeleteLink(la.Name)
+		return nil, err
+	}
+	return mac, nil
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"github.com/vishvananda/netlink"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseSubInterfaceConfig(t *testing.T) {
+	config, err := ParseSubInterfaceConfig("eth0,192.168.1.10/24,192.168.1.1")
+	if err != nil {
+		t.Fatalf("parse %v", err)
+	}
+	if config.Parent != "eth0" || config.Address.String() != "192.168.1.10/24" || config.Gateway.String() != "192.168.1.1" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	for _, arg := range []string{"eth0", ",192.168.1.10/24", "eth0,192.168.1.10", "eth0,192.168.1.10/24,10.0.0.1"} {
+		if _, err = ParseSubInterfaceConfig(arg); err == nil {
+			t.Fatalf("parse %s should fail", arg)
+		}
+	}
+}
+
+// createParent 创建用于测试的父接口，优先使用 dummy，内核不支持时使用 veth
+func createParent(t *testing.T, name string) {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: la}); err != nil {
+		if err = CreateVethPair(name, name+"p", ""); err != nil {
+			t.Fatalf("create parent %s %v", name, err)
+		}
+	}
+	if err := SetLinkUp(name); err != nil {
+		t.Fatalf("set parent up %v", err)
+	}
+}
+
+// startContainerProcess 启动一个运行在新 Net Namespace 中的进程作为容器
+func startContainerProcess(t *testing.T) *exec.Cmd {
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start container process %v", err)
+	}
+	return cmd
+}
+
+func stopContainerProcess(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+}
+
+func testSubInterface(t *testing.T, kind string) {
+	withTempNetNS(t, func() {
+		createParent(t, "parent0")
+		cmd := startContainerProcess(t)
+		defer stopContainerProcess(cmd)
+
+		config, _ := ParseSubInterfaceConfig("parent0,10.88.0.10/24,10.88.0.1")
+		_, err := ConnectSubInterface(kind, "1234567890", cmd.Process.Pid, config)
+		if err != nil {
+			if strings.Contains(err.Error(), "not supported") {
+				t.Skipf("%s not supported by kernel: %v", kind, err)
+			}
+			t.Fatalf("connect %s %v", kind, err)
+		}
+
+		exit, err := enterContainerNetNS(cmd.Process.Pid)
+		if err != nil {
+			t.Fatalf("enter container netns %v", err)
+		}
+		defer exit()
+		link, err := netlink.LinkByName(ContainerIfName)
+		if err != nil {
+			t.Fatalf("get %s in container %v", ContainerIfName, err)
+		}
+		if link.Type() != kind {
+			t.Fatalf("expect %s link, got %s", kind, link.Type())
+		}
+		if !linkIsUp(t, ContainerIfName) {
+			t.Fatalf("%s should be up", ContainerIfName)
+		}
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+		if len(addrs) != 1 || addrs[0].IPNet.String() != "10.88.0.10/24" {
+			t.Fatalf("unexpected addrs %v", addrs)
+		}
+		routes, _ := netlink.RouteList(link, netlink.FAMILY_V4)
+		hasDefault := false
+		for _, route := range routes {
+			if route.Gw != nil && route.Gw.String() == "10.88.0.1" {
+				hasDefault = true
+			}
+		}
+		if !hasDefault {
+			t.Fatalf("default route via 10.88.0.1 not found in %v", routes)
+		}
+	})
+}
+
+func TestConnectMacvlan(t *testing.T) {
+	testSubInterface(t, Macvlan)
+}
+
+func TestConnectIpvlan(t *testing.T) {
+	testSubInterface(t, Ipvlan)
+}
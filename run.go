@@ -1,55 +1,275 @@
 package main
 
 import (
+	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"mydocker/cgroups"
 	"mydocker/cgroups/subsystems"
 	"mydocker/container"
+	"mydocker/image"
+	"mydocker/network"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
 )
 
+// RunOptions run 命令的参数
+type RunOptions struct {
+	Tty           bool                       // 前台运行并连接终端
+	Cmd           []string                   // 用户指定的命令，为空时使用镜像的 Entrypoint、Cmd
+	Resource      *subsystems.ResourceConfig // 资源限制
+	Volume        string                     // 挂载的 volume，格式为 hostPath:containerPath
+	ContainerName string                     // 容器名
+	ImageName     string                     // 镜像名
+	Hostname      string                     // 主机名，为空时使用容器名或者容器 Id
+	Env           []string                   // -e 指定的环境变量
+	Net           string                     // --net 参数，格式见 container.ParseNetMode
+	PortMapping   []string                   // 端口映射，格式为 hostPort:containerPort/proto
+	UserlandProxy bool                       // 端口映射使用 userland proxy 而不是 iptables
+	DNS           *container.DNSConfig       // 自定义 DNS 配置
+	Aliases       []string                   // 容器在网络中的别名
+	IPv6          bool                       // 从网络的 IPv6 网段中为容器分配地址
+}
+
 // Run 执行具体 command
 /*
 这里的Start方法是真正开始执行由NewParentProcess构建好的command的调用，它首先会clone出来一个namespace隔离的
 进程，然后在子进程中，调用/proc/self/exe,也就是调用自己，发送init参数，调用我们写的init方法，
 去初始化容器的一些资源。
 */
-func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, containerName, imageName string, envSlice []string) {
-	containerId := container.GenerateContainerID() // 生成 10 位容器 id
-	parent, writePipe := container.NewParentProcess(tty, volume, containerId, imageName, envSlice)
+func Run(opts *RunOptions) {
+	portMappings, err := network.ParsePortMappings(opts.PortMapping)
+	if err != nil {
+		log.Errorf("Parse port mapping error %v", err)
+		return
+	}
+
+	img, err := image.DefaultStore.Get(opts.ImageName)
+	if err != nil {
+		log.Errorf("Get image %s error %v", opts.ImageName, err)
+		return
+	}
+	imgConfig, err := image.DefaultStore.Config(img)
+	if err != nil {
+		log.Errorf("Get config of image %s error %v", opts.ImageName, err)
+		return
+	}
+	config := newContainerConfig(&imgConfig.Config, opts.Cmd, opts.Env, portMappings)
+	comArray := config.Command(nil)
+	if len(comArray) == 0 {
+		log.Errorf("No command specified and image %s has no Entrypoint or Cmd", opts.ImageName)
+		return
+	}
+
+	containerInfo := &container.Info{
+		Id:            container.GenerateContainerID(), // 生成 10 位容器 id
+		Name:          opts.ContainerName,
+		Command:       strings.Join(comArray, ""),
+		Image:         opts.ImageName,
+		ImageID:       img.ID,
+		Volume:        opts.Volume,
+		PortMapping:   opts.PortMapping,
+		UserlandProxy: opts.UserlandProxy,
+		Hostname:      opts.Hostname,
+		Aliases:       opts.Aliases,
+		Resource:      opts.Resource,
+		Config:        config,
+	}
+	containerId := containerInfo.Id
+	// 未指定主机名时使用容器名，容器名也没有指定时使用容器 id
+	if containerInfo.Hostname == "" {
+		containerInfo.Hostname = opts.ContainerName
+	}
+	if containerInfo.Hostname == "" {
+		containerInfo.Hostname = containerId
+	}
+	// container 模式下找到目标容器的 Net Namespace，容器的 hosts 中也使用目标容器的 IP
+	var netNsPath, hostsIP string
+	netMode, netArg := container.ParseNetMode(opts.Net)
+	if netMode == container.NetModeContainer {
+		targetInfo, err := getInfoByContainerId(netArg)
+		if err != nil {
+			log.Errorf("Get network container %s info error %v", netArg, err)
+			return
+		}
+		if targetInfo.Status != container.RUNNING {
+			log.Errorf("Network container %s is not running", netArg)
+			return
+		}
+		netNsPath = fmt.Sprintf("/proc/%s/ns/net", targetInfo.Pid)
+		hostsIP = targetInfo.IP
+	}
+	// container、macvlan、ipvlan 模式下记录完整的参数
+	containerInfo.NetMode = netMode
+	if netArg != "" && netMode != container.NetModeBridge {
+		containerInfo.NetMode = opts.Net
+	}
+	parent, writePipe := container.NewParentProcess(opts.Tty, opts.Volume, containerId, opts.ImageName, containerInfo.Hostname,
+		netMode, netNsPath, config.Env, config.WorkingDir)
 	if parent == nil {
 		log.Errorf("New parent process error")
 		return
 	}
-	if err := parent.Start(); err != nil {
+	if err = parent.Start(); err != nil {
 		log.Errorf("Run parent.Start err:%v", err)
+		_ = writePipe.Close()
+		releaseContainer(containerInfo)
+		return
 	}
+	containerInfo.Pid = strconv.Itoa(parent.Process.Pid)
 
-	// record container info
-	err := container.RecordContainerInfo(parent.Process.Pid, comArray, containerName, containerId, volume)
-	if err != nil {
-		log.Errorf("Record container info error %v", err)
+	// 此时 init 进程还阻塞在读取管道，任何一步失败都要杀死 init 进程并清理已经创建的资源
+	if err = setupContainer(opts, containerInfo, parent.Process.Pid, portMappings, hostsIP); err != nil {
+		log.Errorf("Setup container %s error %v", containerId, err)
+		cleanupFailedContainer(parent, writePipe, containerInfo)
 		return
 	}
 
 	// 创建cgroup manager, 并通过调用set和apply设置资源限制并使限制在容器上生效
 	cgroupManager := cgroups.NewCgroupManager("mydocker-cgroup")
 	defer cgroupManager.Destroy()
-	_ = cgroupManager.Set(res)
-	_ = cgroupManager.Apply(parent.Process.Pid, res)
+	_ = cgroupManager.Set(opts.Resource)
+	_ = cgroupManager.Apply(parent.Process.Pid, opts.Resource)
 
 	sendInitCommand(comArray, writePipe)
-	if tty { // 如果是tty，那么父进程等待，就是前台运行，否则就是跳过，实现后台运行
+	if opts.Tty { // 如果是tty，那么父进程等待，就是前台运行，否则就是跳过，实现后台运行
 		_ = parent.Wait()
-		container.DeleteWorkSpace(containerId, volume)
-		container.DeleteContainerInfo(containerId)
+		releaseContainer(containerInfo)
+	}
+}
+
+// setupContainer 配置容器的网络、带宽限制和 /etc 文件，并记录容器信息
+/*
+init 进程读取到用户命令之前调用，因此用户命令启动前网络已经配置好了。
+每一步完成后都会把结果记录到 containerInfo 中，失败时 cleanupFailedContainer 根据记录撤销已经完成的配置。
+*/
+func setupContainer(opts *RunOptions, containerInfo *container.Info, pid int, portMappings []*network.PortMapping,
+	hostsIP string) error {
+	containerId := containerInfo.Id
+	netMode, netArg := container.ParseNetMode(opts.Net)
+	switch netMode {
+	case container.NetModeBridge:
+		ep, err := network.Connect(netArg, containerId, pid)
+		if err != nil {
+			return errors.WithMessage(err, "connect network")
+		}
+		containerInfo.NetworkName = ep.Network.Name
+		containerInfo.IP = ep.IPAddress.String()
+		hostsIP = containerInfo.IP
+		if opts.IPv6 {
+			if containerInfo.IPv6, err = network.ConnectIPv6(ep.Network, pid); err != nil {
+				return errors.WithMessage(err, "connect ipv6")
+			}
+		}
+		// 用户创建的网络使用内置 DNS 解析容器名，DNS 进程不在运行时(比如宿主机重启后)重新启动
+		if ep.Network.Name != network.DefaultNetwork && len(opts.DNS.Nameservers) == 0 {
+			if err = startNetworkDNS(ep.Network); err != nil {
+				log.Errorf("Start dns of network %s error %v", ep.Network.Name, err)
+			} else {
+				opts.DNS.Nameservers = []string{ep.Network.Gateway().String()}
+			}
+		}
+		if opts.UserlandProxy {
+			err = network.StartUserlandProxy(fmt.Sprintf(container.InfoLocFormat, containerId), containerInfo.IP, portMappings)
+		} else {
+			err = network.ConfigPortMapping(containerInfo.IP, portMappings)
+		}
+		if err != nil {
+			return errors.WithMessage(err, "config port mapping")
+		}
+	case container.NetModeMacvlan, container.NetModeIpvlan:
+		// 子接口属于容器的 Net Namespace，init 进程退出后会被内核自动删除
+		subConfig, err := network.ParseSubInterfaceConfig(netArg)
+		if err != nil {
+			return errors.WithMessagef(err, "parse %s config", netMode)
+		}
+		if _, err = network.ConnectSubInterface(netMode, containerId, pid, subConfig); err != nil {
+			return errors.WithMessagef(err, "connect %s", netMode)
+		}
+		containerInfo.IP = subConfig.Address.IP.String()
+		hostsIP = containerInfo.IP
+	case container.NetModeCNI:
+		result, err := network.CNIAdd(netArg, containerId, pid)
+		if err != nil {
+			return errors.WithMessagef(err, "add cni network %s", netArg)
+		}
+		containerInfo.CNIResult = result
+		containerInfo.IP = network.CNIResultIP(result)
+		hostsIP = containerInfo.IP
+	}
+
+	// 在容器的 Net Namespace 中配置带宽限制
+	if err := setNetworkBandwidth(pid, netMode, opts.Resource); err != nil {
+		return errors.WithMessage(err, "set network bandwidth")
+	}
+	// 生成容器的 hosts、hostname、resolv.conf，init 进程读取到用户命令后会将其挂载到容器中
+	if err := container.BuildEtcFiles(containerId, containerInfo.Hostname, hostsIP, netMode == container.NetModeHost,
+		opts.DNS); err != nil {
+		return errors.WithMessage(err, "build etc files")
+	}
+	return errors.WithMessage(container.RecordContainerInfo(containerInfo), "record container info")
+}
+
+// cleanupFailedContainer 容器启动失败时杀死阻塞在管道上的 init 进程，并释放容器的所有资源
+// CNI 插件 DEL 时还需要进入容器的 Net Namespace，因此在杀死 init 进程之前执行
+func cleanupFailedContainer(parent *exec.Cmd, writePipe *os.File, containerInfo *container.Info) {
+	deleteCNINetwork(containerInfo, parent.Process.Pid)
+	_ = writePipe.Close()
+	if err := parent.Process.Kill(); err != nil {
+		log.Errorf("Kill init process %d error %v", parent.Process.Pid, err)
+	}
+	_ = parent.Wait()
+	releaseContainer(containerInfo)
+}
+
+// releaseContainer 容器进程退出后删除工作目录、端口映射、网络和容器信息
+func releaseContainer(containerInfo *container.Info) {
+	container.DeleteWorkSpace(containerInfo.Id, containerInfo.Volume)
+	deletePortMapping(containerInfo)
+	if err := network.Disconnect(containerInfo.NetworkName, containerInfo.Id, containerInfo.IP); err != nil {
+		log.Errorf("Disconnect network %s error %v", containerInfo.NetworkName, err)
+	}
+	if err := network.DisconnectIPv6(containerInfo.IPv6); err != nil {
+		log.Errorf("Release ipv6 %s error %v", containerInfo.IPv6, err)
+	}
+	deleteCNINetwork(containerInfo, 0)
+	if err := container.DeleteContainerInfo(containerInfo.Id); err != nil {
+		log.Errorf("Delete container %s info error %v", containerInfo.Id, err)
+	}
+}
+
+// newContainerConfig 以镜像配置为基础生成容器配置
+/*
+- 指定了命令时替换镜像的 Cmd，Entrypoint 保持不变
+- -e 指定的环境变量覆盖镜像中的同名变量
+- 端口映射的容器端口加入 ExposedPorts
+*/
+func newContainerConfig(imgConfig *image.ContainerConfig, args, envSlice []string,
+	portMappings []*network.PortMapping) *image.ContainerConfig {
+	config := &image.ContainerConfig{
+		Env:        image.MergeEnv(imgConfig.Env, envSlice),
+		Entrypoint: imgConfig.Entrypoint,
+		Cmd:        imgConfig.Cmd,
+		WorkingDir: imgConfig.WorkingDir,
+	}
+	if len(args) > 0 {
+		config.Cmd = args
 	}
+	for port := range imgConfig.ExposedPorts {
+		_ = config.ApplyChange("EXPOSE " + port)
+	}
+	for _, pm := range portMappings {
+		_ = config.ApplyChange(fmt.Sprintf("EXPOSE %d/%s", pm.ContainerPort, pm.Protocol))
+	}
+	return config
 }
 
 func sendInitCommand(comArray []string, writePipe *os.File) {
-	command := strings.Join(comArray, " ") // 把命令拼起来
-	log.Infof("command all is %s", command)
-	_, _ = writePipe.WriteString(command) // 然后写到管道里
+	log.Infof("command all is %s", strings.Join(comArray, " "))
+	if err := container.WriteUserCommand(writePipe, comArray); err != nil { // 然后写到管道里
+		log.Errorf("Send init command error %v", err)
+	}
 	_ = writePipe.Close()
 }
@@ -7,6 +7,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"mydocker/constant"
 	"mydocker/container"
+	"mydocker/network"
 	"os"
 	"path"
 	"strconv"
@@ -25,24 +26,20 @@ func stopContainer(containerId string) {
 		log.Errorf("Conver pid from string to int error %v", err)
 		return
 	}
-	// 2.发送SIGTERM信号
+	// 2.容器退出前调用 CNI 插件 DEL，此时插件还可以进入容器的 Net Namespace 清理网卡
+	deleteCNINetwork(containerInfo, pidInt)
+	// 3.发送SIGTERM信号
 	if err = syscall.Kill(pidInt, syscall.SIGTERM); err != nil {
 		log.Errorf("Stop container %s error %v", containerId, err)
 		return
 	}
-	// 3.修改容器信息，将容器置为STOP状态，并清空PID
+	// 4.删除端口映射规则
+	deletePortMapping(containerInfo)
+	// 5.修改容器信息，将容器置为STOP状态，并清空PID
 	containerInfo.Status = container.STOP
 	containerInfo.Pid = " "
-	newContentBytes, err := json.Marshal(containerInfo)
-	if err != nil {
-		log.Errorf("Json marshal %s error %v", containerId, err)
-		return
-	}
-	// 4.重新写回存储容器信息的文件
-	dirPath := fmt.Sprintf(container.InfoLocFormat, containerId)
-	configFilePath := path.Join(dirPath, container.ConfigName)
-	if err := os.WriteFile(configFilePath, newContentBytes, constant.Perm0622); err != nil {
-		log.Errorf("Write file %s error:%v", configFilePath, err)
+	if err = updateContainerInfo(containerInfo); err != nil {
+		log.Errorf("Update container %s info error %v", containerId, err)
 	}
 }
 
@@ -60,6 +57,51 @@ func getInfoByContainerId(containerId string) (*container.Info, error) {
 	return &containerInfo, nil
 }
 
+// updateContainerInfo 将修改后的容器信息写回 config.json
+func updateContainerInfo(containerInfo *container.Info) error {
+	newContentBytes, err := json.Marshal(containerInfo)
+	if err != nil {
+		return errors.Wrapf(err, "json marshal %s", containerInfo.Id)
+	}
+	dirPath := fmt.Sprintf(container.InfoLocFormat, containerInfo.Id)
+	configFilePath := path.Join(dirPath, container.ConfigName)
+	if err = os.WriteFile(configFilePath, newContentBytes, constant.Perm0622); err != nil {
+		return errors.Wrapf(err, "write file %s", configFilePath)
+	}
+	return nil
+}
+
+// deletePortMapping 删除容器的端口映射规则，使用 userland proxy 时则停止 proxy 进程
+func deletePortMapping(containerInfo *container.Info) {
+	if containerInfo.UserlandProxy {
+		network.StopUserlandProxy(fmt.Sprintf(container.InfoLocFormat, containerInfo.Id))
+		return
+	}
+	if containerInfo.IP == "" || len(containerInfo.PortMapping) == 0 {
+		return
+	}
+	portMappings, err := network.ParsePortMappings(containerInfo.PortMapping)
+	if err != nil {
+		log.Errorf("Parse port mapping of container %s error %v", containerInfo.Id, err)
+		return
+	}
+	network.DeletePortMapping(containerInfo.IP, portMappings)
+}
+
+// deleteCNINetwork cni 模式下调用插件 DEL 将容器从 CNI 网络中删除，成功后清空记录的结果避免重复删除
+// 容器已经退出时 pid 传 0
+func deleteCNINetwork(containerInfo *container.Info, pid int) {
+	netMode, netArg := container.ParseNetMode(containerInfo.NetMode)
+	if netMode != container.NetModeCNI || containerInfo.CNIResult == nil {
+		return
+	}
+	if err := network.CNIDel(netArg, containerInfo.Id, pid, containerInfo.CNIResult); err != nil {
+		log.Errorf("Delete cni network %s of container %s error %v", netArg, containerInfo.Id, err)
+		return
+	}
+	containerInfo.CNIResult = nil
+}
+
 func removeContainer(containerId string, force bool) {
 	containerInfo, err := getInfoByContainerId(containerId)
 	if err != nil {
@@ -75,6 +117,14 @@ func removeContainer(containerId string, force bool) {
 			return
 		}
 		container.DeleteWorkSpace(containerId, containerInfo.Volume)
+		deletePortMapping(containerInfo)
+		if err = network.Disconnect(containerInfo.NetworkName, containerId, containerInfo.IP); err != nil {
+			log.Errorf("Disconnect network %s error %v", containerInfo.NetworkName, err)
+		}
+		if err = network.DisconnectIPv6(containerInfo.IPv6); err != nil {
+			log.Errorf("Release ipv6 %s error %v", containerInfo.IPv6, err)
+		}
+		deleteCNINetwork(containerInfo, 0)
 	case container.RUNNING: // RUNNING 状态容器如果指定了 force 则先 stop 然后再删除
 		if !force {
 			log.Errorf("Couldn't remove running container [%s], Stop the container before attempting removal or"+
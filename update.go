@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"mydocker/cgroups/subsystems"
+	"mydocker/container"
+	"mydocker/network"
+)
+
+// updateContainer 修改运行中容器的网络带宽限制，参数为 nil 时保持原有的配置
+func updateContainer(containerId string, netRate, netIngressRate *string) error {
+	containerInfo, pid, err := getRunningContainer(containerId)
+	if err != nil {
+		return err
+	}
+	if containerInfo.Resource == nil {
+		containerInfo.Resource = &subsystems.ResourceConfig{}
+	}
+	if netRate != nil {
+		containerInfo.Resource.NetRate = *netRate
+	}
+	if netIngressRate != nil {
+		containerInfo.Resource.NetIngressRate = *netIngressRate
+	}
+	netMode, _ := container.ParseNetMode(containerInfo.NetMode)
+	if err = setNetworkBandwidth(pid, netMode, containerInfo.Resource); err != nil {
+		return errors.WithMessagef(err, "set network bandwidth of container %s", containerId)
+	}
+	return updateContainerInfo(containerInfo)
+}
+
+// setNetworkBandwidth 根据资源配置限制容器网络带宽
+// host、container 模式下容器没有自己的 Net Namespace，限速会影响到宿主机或者其他容器，因此不支持
+func setNetworkBandwidth(pid int, netMode string, res *subsystems.ResourceConfig) error {
+	if res == nil {
+		return nil
+	}
+	egress, err := network.ParseRate(res.NetRate)
+	if err != nil {
+		return err
+	}
+	ingress, err := network.ParseRate(res.NetIngressRate)
+	if err != nil {
+		return err
+	}
+	if netMode == container.NetModeHost || netMode == container.NetModeContainer {
+		if egress != 0 || ingress != 0 {
+			return fmt.Errorf("bandwidth limit is not supported in %s network mode", netMode)
+		}
+		return nil
+	}
+	return network.SetBandwidth(pid, egress, ingress)
+}
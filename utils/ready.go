@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	// envReadyFd 通过环境变量告诉子进程就绪管道的文件描述符，没有这个环境变量时 NotifyReady 什么都不做
+	envReadyFd = "mydocker_ready_fd"
+	// readyMsg 子进程就绪后写入管道的内容
+	readyMsg = "ready"
+	// ReadyTimeout 等待子进程就绪的默认超时时间
+	ReadyTimeout = 5 * time.Second
+)
+
+// StartAndWaitReady 启动 cmd 并等待子进程调用 NotifyReady，超时或者子进程提前退出时杀死子进程并返回错误
+/*
+就绪管道通过 ExtraFiles 传给子进程，子进程完成初始化(例如监听端口)后写入 ready。
+子进程退出时管道的写端被关闭，父进程读到 EOF，因此不需要等到超时就能知道启动失败，失败原因在子进程的日志中。
+*/
+func StartAndWaitReady(cmd *exec.Cmd, timeout time.Duration) error {
+	readPipe, writePipe, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "create ready pipe")
+	}
+	defer readPipe.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, writePipe)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	// ExtraFiles 中的第 i 个文件在子进程中的文件描述符为 3+i
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", envReadyFd, 2+len(cmd.ExtraFiles)))
+	err = cmd.Start()
+	// 关闭父进程持有的写端，子进程退出后才能读到 EOF
+	_ = writePipe.Close()
+	if err != nil {
+		return err
+	}
+
+	_ = readPipe.SetReadDeadline(time.Now().Add(timeout))
+	msg := make([]byte, len(readyMsg))
+	if _, err = io.ReadFull(readPipe, msg); err != nil || string(msg) != readyMsg {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if os.IsTimeout(err) {
+			return fmt.Errorf("process %d not ready in %s", cmd.Process.Pid, timeout)
+		}
+		return fmt.Errorf("process %d exited before ready", cmd.Process.Pid)
+	}
+	return nil
+}
+
+// NotifyReady 通知通过 StartAndWaitReady 启动当前进程的父进程已经就绪
+func NotifyReady() {
+	var fd int
+	if _, err := fmt.Sscanf(os.Getenv(envReadyFd), "%d", &fd); err != nil {
+		return
+	}
+	_ = os.Unsetenv(envReadyFd)
+	pipe := os.NewFile(uintptr(fd), "ready")
+	_, _ = pipe.WriteString(readyMsg)
+	_ = pipe.Close()
+}
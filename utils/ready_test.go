@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const envReadyHelper = "mydocker_ready_helper"
+
+// TestReadyHelperProcess 被 TestStartAndWaitReady 作为子进程运行
+func TestReadyHelperProcess(t *testing.T) {
+	switch os.Getenv(envReadyHelper) {
+	case "ready":
+		NotifyReady()
+		os.Exit(0)
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func TestStartAndWaitReady(t *testing.T) {
+	for mode, expectReady := range map[string]bool{"ready": true, "exit": false, "hang": false} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReadyHelperProcess$")
+		cmd.Env = append(os.Environ(), envReadyHelper+"="+mode)
+		err := StartAndWaitReady(cmd, 500*time.Millisecond)
+		if expectReady && err != nil {
+			t.Fatalf("%s: expect ready, got %v", mode, err)
+		}
+		if !expectReady && err == nil {
+			t.Fatalf("%s: expect error", mode)
+		}
+		if err == nil {
+			_ = cmd.Wait()
+		}
+	}
+}
@@ -6,6 +6,7 @@ import "fmt"
 const (
 	ImagePath       = "/var/lib/mydocker/image/"
 	RootPath        = "/var/lib/mydocker/overlay2/"
+	LayerPath       = RootPath + "layers/" // 解压后的只读镜像层，所有容器共享
 	lowerDirFormat  = RootPath + "%s/lower"
 	upperDirFormat  = RootPath + "%s/upper"
 	workDirFormat   = RootPath + "%s/work"
@@ -15,8 +16,6 @@ const (
 
 func GetRoot(containerID string) string { return RootPath + containerID }
 
-func GetImage(imageName string) string { return fmt.Sprintf("%s%s.tar", ImagePath, imageName) }
-
 func GetLower(containerID string) string {
 	return fmt.Sprintf(lowerDirFormat, containerID)
 }